@@ -0,0 +1,158 @@
+package largefile
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"storj.io/storj/storagenode/blobstore"
+	"sync"
+	"time"
+)
+
+// Access is an access time of a piece, recorded by Index.Touch.
+type Access struct {
+	Ref  blobstore.BlobRef
+	Time time.Time
+}
+
+// AccessTimeConfig defines how the access times of the opened pieces are tracked.
+type AccessTimeConfig struct {
+	// Disabled turns off the tracking, the access times remain the creation times.
+	Disabled bool `help:"don't track the access times of the pieces" default:"false"`
+	// Interval is the time between two flushes of the collected access times to the index.
+	Interval time.Duration `help:"time between two flushes of the collected access times" default:"1m"`
+	// Granularity is the precision of the access times: a piece is updated at most once in each
+	// period.
+	Granularity time.Duration `help:"precision of the access times, a piece is updated at most once in each period" default:"1h"`
+}
+
+// DefaultAccessTimeConfig flushes the access times every minute with hourly precision.
+var DefaultAccessTimeConfig = AccessTimeConfig{
+	Interval:    time.Minute,
+	Granularity: time.Hour,
+}
+
+// accessTracker collects the access times of the opened pieces in memory and writes them to the
+// index in batches, so opening a piece doesn't require a database write.
+type accessTracker struct {
+	log   *zap.Logger
+	index Index
+	// now is the clock of the access times.
+	now func() time.Time
+
+	mu      sync.Mutex
+	config  AccessTimeConfig
+	pending map[pieceKey]Access
+
+	changed chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	closing sync.Once
+}
+
+func newAccessTracker(log *zap.Logger, index Index, config AccessTimeConfig) *accessTracker {
+	t := &accessTracker{
+		log:     log,
+		index:   index,
+		now:     time.Now,
+		config:  config,
+		pending: map[pieceKey]Access{},
+		changed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// setConfig replaces the configuration. The collected access times are kept even if the tracking
+// is disabled, they are written by the next flush.
+func (t *accessTracker) setConfig(config AccessTimeConfig) {
+	t.mu.Lock()
+	t.config = config
+	t.mu.Unlock()
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+}
+
+// touch records the access of the piece, unless its access time is already in the current period.
+func (t *accessTracker) touch(piece Piece) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.config.Disabled {
+		return
+	}
+	now := t.now().UTC()
+	if t.config.Granularity > 0 {
+		now = now.Truncate(t.config.Granularity)
+		if !now.After(piece.Accessed) {
+			return
+		}
+	}
+	t.pending[keyOf(piece.Ref)] = Access{Ref: piece.Ref, Time: now}
+}
+
+// flush writes the collected access times to the index. They are kept for the next flush if the
+// write fails.
+func (t *accessTracker) flush(ctx context.Context) error {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = map[pieceKey]Access{}
+	t.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	batch := make([]Access, 0, len(pending))
+	for _, access := range pending {
+		batch = append(batch, access)
+	}
+	err := t.index.Touch(ctx, batch)
+	if err != nil {
+		mon.Counter("access_time_flush_errors").Inc(1)
+		t.mu.Lock()
+		for k, access := range pending {
+			if _, found := t.pending[k]; !found {
+				t.pending[k] = access
+			}
+		}
+		t.mu.Unlock()
+		return err
+	}
+	mon.IntVal("access_time_flushed").Observe(int64(len(batch)))
+	return nil
+}
+
+func (t *accessTracker) run() {
+	defer close(t.done)
+	for {
+		t.mu.Lock()
+		interval := t.config.Interval
+		t.mu.Unlock()
+		if interval <= 0 {
+			interval = DefaultAccessTimeConfig.Interval
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+			if err := t.flush(context.Background()); err != nil {
+				t.log.Warn("access times are not saved", zap.Error(err))
+			}
+		case <-t.changed:
+			timer.Stop()
+		case <-t.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Close stops the background flushes and writes the remaining access times. It can be called more
+// than once.
+func (t *accessTracker) Close() error {
+	t.closing.Do(func() { close(t.stop) })
+	<-t.done
+	return t.flush(context.Background())
+}
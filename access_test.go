@@ -0,0 +1,56 @@
+package largefile
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"storj.io/common/testrand"
+	"storj.io/storj/storagenode/blobstore"
+	"testing"
+	"time"
+)
+
+func TestAccessTime(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("piece")}
+		w, err := store.Create(ctx, ref, 100)
+		require.NoError(t, err)
+		_, err = w.Write(testrand.BytesInt(100))
+		require.NoError(t, err)
+		require.NoError(t, w.Commit(ctx))
+		created, err := store.index.Get(ctx, ref)
+		require.NoError(t, err)
+		now := created.Accessed
+		store.access.now = func() time.Time { return now }
+
+		open := func() {
+			r, err := store.Open(ctx, ref)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+		}
+		accessed := func() time.Time {
+			piece, err := store.index.Get(ctx, ref)
+			require.NoError(t, err)
+			return piece.Accessed
+		}
+
+		// already accessed in the current hour
+		open()
+		require.NoError(t, store.FlushAccessTimes(ctx))
+		require.True(t, accessed().Equal(created.Accessed))
+
+		store.SetAccessTimeConfig(AccessTimeConfig{Disabled: true})
+		now = created.Accessed.Add(2 * time.Hour)
+		open()
+		require.NoError(t, store.FlushAccessTimes(ctx))
+		require.True(t, accessed().Equal(created.Accessed))
+
+		store.SetAccessTimeConfig(AccessTimeConfig{Interval: time.Hour, Granularity: time.Hour})
+		open()
+		require.True(t, accessed().Equal(created.Accessed), "only written by the flush")
+		require.NoError(t, store.FlushAccessTimes(ctx))
+		require.True(t, accessed().After(created.Accessed))
+
+		// closed again by the store
+		require.NoError(t, store.access.Close())
+	})
+}
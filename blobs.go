@@ -2,18 +2,19 @@ package largefile
 
 import (
 	"context"
-	"database/sql"
+	"crypto/rand"
 	"encoding/base32"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"encoding/hex"
 	"github.com/pkg/errors"
 	"github.com/zeebo/errs"
+	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
-	"io"
 	"os"
 	"path/filepath"
 	"storj.io/common/storj"
 	"storj.io/storj/storagenode/blobstore"
 	"storj.io/storj/storagenode/blobstore/filestore"
+	"sync"
 	"time"
 )
 
@@ -22,32 +23,106 @@ var verificationFileName = "storage-largefile-verification"
 var PathEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
 
 type LargeFileStore struct {
-	conn *sql.DB
-	dir  string
+	log          *zap.Logger
+	config       Config
+	index        Index
+	dir          string
+	segments     *segments
+	files        *fileCache
+	access       *accessTracker
+	compactionMu sync.Mutex
+	// lock is the locked file of the store dir, see lockDir.
+	lock *os.File
+	// stopCompaction cancels the background compaction, compactionDone is closed when it's finished.
+	stopCompaction context.CancelFunc
+	compactionDone chan struct{}
 }
 
 var _ blobstore.Blobs = &LargeFileStore{}
 
-func NewBlobStore(connDef string, dir string) (*LargeFileStore, error) {
-	conn, err := sql.Open("pgx", connDef)
+// NewBlobStore validates the configuration, opens (and migrates) the metadata backend and the store
+// directory.
+func NewBlobStore(log *zap.Logger, config Config) (*LargeFileStore, error) {
+	err := config.Validate()
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
+	}
+	lock, err := lockDir(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	metadataDir := config.MetadataDir
+	if metadataDir == "" {
+		metadataDir = config.Dir
+	}
+	index, err := OpenIndex(context.Background(), config.Connection, metadataDir, config.Instance)
+	if err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+	if log, ok := index.(*logIndex); ok {
+		log.setSyncMode(config.Sync)
+	}
+
+	segments, err := newSegments(config.Dir, config.Sync, config.SyncDelay)
+	if err != nil {
+		_ = index.Close()
+		_ = lock.Close()
+		return nil, err
 	}
 
-	_ = InitTable(conn)
-	//instance := os.Getenv("STORE_INSTANCE")
-	return &LargeFileStore{
-		dir:  dir,
-		conn: conn,
-	}, nil
+	store := &LargeFileStore{
+		log:      log,
+		config:   config,
+		dir:      config.Dir,
+		index:    index,
+		segments: segments,
+		files:    newFileCache(config.Dir, config.FileCacheSize),
+		access:   newAccessTracker(log, index, config.AccessTime),
+		lock:     lock,
+	}
+	store.SetMmap(config.Mmap)
+	if !config.Compaction.Disabled {
+		ctx, cancel := context.WithCancel(context.Background())
+		store.stopCompaction = cancel
+		store.compactionDone = make(chan struct{})
+		go func() {
+			defer close(store.compactionDone)
+			store.runCompaction(ctx)
+		}()
+	}
+	return store, nil
+}
+
+// SetMmap switches between reading the pieces with read syscalls (default) and serving them from
+// memory mapped segment files. Only the files which are not written anymore are mapped, the change
+// affects the files opened after the call.
+func (b *LargeFileStore) SetMmap(enabled bool) {
+	if !enabled {
+		b.files.setMmap(nil)
+		return
+	}
+	b.files.setMmap(func(name string) bool {
+		return !b.segments.inUse(name)
+	})
+}
+
+// SetAccessTimeConfig changes how the access times of the opened pieces are tracked.
+func (b *LargeFileStore) SetAccessTimeConfig(config AccessTimeConfig) {
+	b.access.setConfig(config)
+}
 
+// FlushAccessTimes writes the collected access times to the index.
+func (b *LargeFileStore) FlushAccessTimes(ctx context.Context) error {
+	return b.access.flush(ctx)
 }
+
 func (b *LargeFileStore) Create(ctx context.Context, ref blobstore.BlobRef, size int64) (blobstore.BlobWriter, error) {
-	return NewWriter(b.conn, b.dir, ref)
+	return NewWriter(b.index, b.segments, ref, size)
 }
 
 func (b *LargeFileStore) Open(ctx context.Context, ref blobstore.BlobRef) (blobstore.BlobReader, error) {
-	return NewReader(b.conn, b.dir, ref)
+	return NewReader(ctx, b.index, b.files, b.access, ref)
 }
 
 func (b *LargeFileStore) OpenWithStorageFormat(ctx context.Context, ref blobstore.BlobRef, formatVer blobstore.FormatVersion) (blobstore.BlobReader, error) {
@@ -57,9 +132,15 @@ func (b *LargeFileStore) OpenWithStorageFormat(ctx context.Context, ref blobstor
 	return b.Open(ctx, ref)
 }
 
+// Delete removes the piece and its slot. A file owned by the piece alone is removed immediately,
+// the bytes inside a shared segment become dead space for the compaction.
 func (b *LargeFileStore) Delete(ctx context.Context, ref blobstore.BlobRef) error {
-	_, err := b.conn.Exec("DELETE FROM pieces WHERE namespace=$1 AND key=$2", ref.Namespace, ref.Key)
-	return errors.WithStack(err)
+	pieces, err := b.index.Delete(ctx, ref)
+	if err != nil {
+		return err
+	}
+	_, err = b.reclaim(ctx, pieces)
+	return err
 }
 
 func (b *LargeFileStore) DeleteWithStorageFormat(ctx context.Context, ref blobstore.BlobRef, formatVer blobstore.FormatVersion) error {
@@ -70,90 +151,204 @@ func (b *LargeFileStore) DeleteWithStorageFormat(ctx context.Context, ref blobst
 }
 
 func (b *LargeFileStore) DeleteNamespace(ctx context.Context, ref []byte) (err error) {
-	_, err = b.conn.Exec("UPDATE pieces SET deleted = true WHERE namespace = $1", ref)
-	// todo delete files
-	return errors.WithStack(err)
+	return b.DeleteNamespaceWithProgress(ctx, ref, nil)
+}
+
+// deleteNamespaceBatch is the number of pieces deleted in one transaction by DeleteNamespace.
+const deleteNamespaceBatch = 1000
+
+// DeleteNamespaceProgress is reported after each deleted batch of DeleteNamespaceWithProgress.
+type DeleteNamespaceProgress struct {
+	Pieces int
+	Bytes  int64
+	// TotalBytes is the size of the (trashed or not) pieces of the namespace at the beginning.
+	TotalBytes int64
+	// Files is the number of removed files, reported at the end.
+	Files int
+}
+
+// DeleteNamespaceWithProgress deletes all the pieces of the namespace in batches, and calls progress
+// (if not nil) after each batch. The files which are not used by other pieces are removed at the
+// end, the shared segments with remaining pieces become candidates of the compaction.
+func (b *LargeFileStore) DeleteNamespaceWithProgress(ctx context.Context, namespace []byte, progress func(DeleteNamespaceProgress)) error {
+	var status DeleteNamespaceProgress
+	blobs, err := b.index.SpaceUsedForBlobsInNamespace(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	trash, err := b.index.SpaceUsedForTrashInNamespace(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	status.TotalBytes = blobs + trash
+
+	files := map[string]Piece{}
+	for {
+		pieces, err := b.index.DeleteNamespace(ctx, namespace, deleteNamespaceBatch)
+		if err != nil {
+			return err
+		}
+		if len(pieces) == 0 {
+			break
+		}
+		for _, piece := range pieces {
+			status.Pieces++
+			status.Bytes += piece.Size
+			files[piece.Slot.File] = piece
+		}
+		if progress != nil {
+			progress(status)
+		}
+	}
+
+	var reclaimed []Piece
+	for _, piece := range files {
+		reclaimed = append(reclaimed, piece)
+	}
+	status.Files, err = b.reclaim(ctx, reclaimed)
+	if progress != nil {
+		progress(status)
+	}
+	return err
 }
 
-func (b *LargeFileStore) RenameRef(ctx context.Context, ref1 blobstore.BlobRef, name string) error {
-	var currentFileName string
-	err := b.conn.QueryRow("SELECT file FROM pieces WHERE namespace = $1 AND key =$2", ref1.Namespace, ref1.Key).Scan(&currentFileName)
+// RenameRef moves the piece to a standalone file (relative to the store dir). Only the byte range of
+// the piece is copied, the other pieces of the same segment are not touched.
+func (b *LargeFileStore) RenameRef(ctx context.Context, ref1 blobstore.BlobRef, name string) (err error) {
+	b.compactionMu.Lock()
+	defer b.compactionMu.Unlock()
+
+	piece, err := b.index.Get(ctx, ref1)
+	if err != nil {
+		return err
+	}
+	if piece.Slot.File == name {
+		return nil
+	}
+
+	destPath := filepath.Join(b.dir, name)
+	err = os.MkdirAll(filepath.Dir(destPath), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	dest, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	moved := false
+	defer func() {
+		err = errs.Combine(err, dest.Close())
+		if !moved {
+			_ = os.Remove(destPath)
+		}
+	}()
+
+	src, err := os.Open(filepath.Join(b.dir, piece.Slot.File))
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	f1 := filepath.Join(b.dir, currentFileName)
-	f2 := filepath.Join(b.dir, name)
-	dest, err := os.Create(f2)
+	checksum, err := copyRange(dest, 0, src, piece.Slot.Start, piece.Slot.Size)
+	err = errs.Combine(err, src.Close())
 	if err != nil {
 		return err
 	}
-	defer dest.Close()
-	src, err := os.Open(f1)
+	if piece.Slot.Checksum != nil && *piece.Slot.Checksum != checksum {
+		return ErrCorruption.New("checksum mismatch of piece in %s at %d", piece.Slot.File, piece.Slot.Start)
+	}
+	err = b.syncFile(dest)
 	if err != nil {
 		return err
 	}
-	defer src.Close()
-	_, err = io.Copy(dest, src)
+	err = b.syncDir(filepath.Dir(destPath))
 	if err != nil {
 		return err
 	}
-	_, err = b.conn.Exec("UPDATE pieces SET file=$1 WHERE file = $2", name, currentFileName)
+
+	applied, err := b.index.Relocate(ctx, []Relocation{{
+		Ref:  ref1,
+		From: piece.Slot.ID,
+		To: Slot{
+			File:     name,
+			Size:     piece.Slot.Size,
+			Checksum: piece.Slot.Checksum,
+		},
+	}})
+	// the index may point to the new file (even if the commit reported an error), it must be kept
+	moved = applied > 0
 	if err != nil {
-		return errors.WithStack(err)
+		return err
+	}
+	if !moved {
+		return errs.New("piece is modified during the rename")
 	}
-	err = os.Remove(f1)
+
+	_, err = b.reclaim(ctx, []Piece{piece})
+	return err
+}
+
+// Import adds an existing file (relative to the store dir) to the index as the piece. The checksum
+// of the imported piece is unknown.
+func (b *LargeFileStore) Import(ctx context.Context, ref blobstore.BlobRef, file string) error {
+	stat, err := os.Stat(filepath.Join(b.dir, file))
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	return nil
+	return b.index.Insert(ctx, ref, Slot{
+		File: file,
+		Size: stat.Size(),
+	})
 }
 
 func (b *LargeFileStore) Trash(ctx context.Context, ref blobstore.BlobRef) error {
-	_, err := b.conn.Exec("UPDATE pieces SET trash = true WHERE namespace = $1 and key = $2", ref.Namespace, ref.Key)
-	return errors.WithStack(err)
+	return b.index.Trash(ctx, ref)
 }
 
 func (b *LargeFileStore) RestoreTrash(ctx context.Context, namespace []byte) ([][]byte, error) {
-	keys := make([][]byte, 0)
-	rows, err := b.conn.Query("UPDATE pieces SET trash = false where namespace = $1 RETURNING key", namespace)
-	defer rows.Close()
-	for rows.Next() {
-		var key []byte
-		err := rows.Scan(&key)
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
-		keys = append(keys, key)
-	}
-	return keys, errors.WithStack(err)
+	return b.index.RestoreTrash(ctx, namespace)
 }
 
 func (b *LargeFileStore) EmptyTrash(ctx context.Context, namespace []byte, trashedBefore time.Time) (int64, [][]byte, error) {
-	_, err := b.conn.Exec("DELETE FROM pieces where namespace = $1 AND trash = true", namespace)
-	return 0, [][]byte{}, errors.WithStack(err)
-}
-
-func (b *LargeFileStore) Stat(ctx context.Context, ref blobstore.BlobRef) (blobstore.BlobInfo, error) {
-	rows, err := b.conn.Query("select size,created from pieces where namespace=$1 AND key=$2 AND NOT trash", ref.Namespace, ref.Key)
+	pieces, err := b.index.EmptyTrash(ctx, namespace, trashedBefore)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return 0, nil, err
 	}
-	defer rows.Close()
-	if !rows.Next() {
-		return nil, os.ErrNotExist
+	var emptied int64
+	keys := make([][]byte, 0, len(pieces))
+	for _, piece := range pieces {
+		emptied += piece.Size
+		keys = append(keys, piece.Ref.Key)
 	}
-	var size int64
-	var created time.Time
-	err = rows.Scan(&size, &created)
+	_, err = b.reclaim(ctx, pieces)
+	return emptied, keys, err
+}
+
+// reclaim removes the files of the deleted pieces which are not used by any other piece. Shared
+// segments which still have pieces are freed up by the compaction.
+func (b *LargeFileStore) reclaim(ctx context.Context, pieces []Piece) (removed int, err error) {
+	var group errs.Group
+	seen := map[string]bool{}
+	for _, piece := range pieces {
+		file := piece.Slot.File
+		if file == "" || seen[file] || b.segments.inUse(file) {
+			continue
+		}
+		seen[file] = true
+		ok, err := b.removeUnused(ctx, file)
+		group.Add(err)
+		if ok {
+			removed++
+		}
+	}
+	return removed, group.Err()
+}
+
+func (b *LargeFileStore) Stat(ctx context.Context, ref blobstore.BlobRef) (blobstore.BlobInfo, error) {
+	piece, err := b.index.Get(ctx, ref)
 	if err != nil {
 		return nil, err
 	}
 
-	return BlobInfo{
-		ref:     ref,
-		created: created,
-		size:    size,
-	}, nil
+	return newBlobInfo(b.dir, piece), nil
 }
 
 func (b *LargeFileStore) StatWithStorageFormat(ctx context.Context, ref blobstore.BlobRef, formatVer blobstore.FormatVersion) (blobstore.BlobInfo, error) {
@@ -163,136 +358,229 @@ func (b *LargeFileStore) StatWithStorageFormat(ctx context.Context, ref blobstor
 	return b.Stat(ctx, ref)
 }
 
+// FreeSpace returns the space available on the file system of the store, minus the reserved space
+// of the configuration.
 func (b *LargeFileStore) FreeSpace(ctx context.Context) (int64, error) {
 	var stat unix.Statfs_t
 	err := unix.Statfs(b.dir, &stat)
 	if err != nil {
-		return 0, err
+		return 0, errors.WithStack(err)
 	}
 
 	// the Bsize size depends on the OS and unconvert gives a false-positive
 	availableSpace := int64(stat.Bavail) * int64(stat.Bsize) //nolint: unconvert
 
-	return availableSpace * 100, nil
+	free := availableSpace - b.config.ReservedSpace.Int64()
+	if free < 0 {
+		free = 0
+	}
+	return free, nil
 }
 
-func (b *LargeFileStore) CheckWritability(ctx context.Context) error {
-	return nil
+// ReclaimableSpace is the disk space used by the store, but not by the pieces.
+type ReclaimableSpace struct {
+	// Dead is the number of allocated bytes in the sealed files which don't belong to any (trashed
+	// or not) piece.
+	Dead int64
+	// Compactable is the part of Dead in the files over the compaction threshold, which is freed by
+	// the next compaction.
+	Compactable int64
+	// Reserved is the preallocated but not yet written space of the uploads in progress.
+	Reserved int64
 }
 
-func (b *LargeFileStore) SpaceUsedForTrash(ctx context.Context) (res int64, err error) {
-	rows, err := b.conn.Query("SELECT count(size) FROM pieces WHERE trash")
+// ReclaimableSpace returns the space which becomes free without deleting any piece.
+func (b *LargeFileStore) ReclaimableSpace(ctx context.Context) (space ReclaimableSpace, err error) {
+	files, err := b.sealedFiles(ctx)
 	if err != nil {
-		return 0, errors.WithStack(err)
+		return space, err
 	}
-	defer rows.Close()
-	if !rows.Next() {
-		return 0, errors.New("No such result")
+	for _, file := range files {
+		if file.size <= file.live {
+			continue
+		}
+		space.Dead += file.size - file.live
+		if file.overThreshold(b.config.Compaction.Threshold) {
+			space.Compactable += file.size - file.live
+		}
 	}
-	err = rows.Scan(&res)
-	return res, err
+	space.Reserved = b.segments.reserved()
+	return space, nil
 }
 
-func (b *LargeFileStore) SpaceUsedForBlobs(ctx context.Context) (res int64, err error) {
-	rows, err := b.conn.Query("SELECT sum(size) FROM pieces WHERE NOT trash")
+// CheckWritability creates and removes a probe file in the store directory.
+func (b *LargeFileStore) CheckWritability(ctx context.Context) error {
+	f, err := os.CreateTemp(b.dir, "write-test")
 	if err != nil {
-		return 0, errors.WithStack(err)
-	}
-	defer rows.Close()
-	if !rows.Next() {
-		return 0, errors.New("No such result")
+		return errors.WithStack(err)
 	}
-	var value *int64
-	err = rows.Scan(&value)
-	if value != nil {
-		res = *value
+	err = f.Close()
+	if err != nil {
+		return errs.Combine(errors.WithStack(err), os.Remove(f.Name()))
 	}
-	return res, err
+	return errors.WithStack(os.Remove(f.Name()))
+}
+
+func (b *LargeFileStore) SpaceUsedForTrash(ctx context.Context) (res int64, err error) {
+	return b.index.SpaceUsedForTrash(ctx)
+}
+
+// SpaceUsedForTrashInNamespace returns the bytes of the trashed pieces in the namespace.
+func (b *LargeFileStore) SpaceUsedForTrashInNamespace(ctx context.Context, namespace []byte) (res int64, err error) {
+	return b.index.SpaceUsedForTrashInNamespace(ctx, namespace)
+}
+
+func (b *LargeFileStore) SpaceUsedForBlobs(ctx context.Context) (res int64, err error) {
+	return b.index.SpaceUsedForBlobs(ctx)
 }
 
 func (b *LargeFileStore) SpaceUsedForBlobsInNamespace(ctx context.Context, namespace []byte) (res int64, err error) {
-	rows, err := b.conn.Query("SELECT sum(size) FROM pieces WHERE NOT TRASH AND namespace=$1", namespace)
-	if err != nil {
-		return 0, errors.WithStack(err)
-	}
-	defer rows.Close()
-	if !rows.Next() {
-		return 0, errors.New("No such result")
-	}
-	var value *int64
-	err = rows.Scan(&value)
-	if value != nil {
-		res = *value
-	}
-	return res, err
+	return b.index.SpaceUsedForBlobsInNamespace(ctx, namespace)
 }
 
 func (b *LargeFileStore) ListNamespaces(ctx context.Context) ([][]byte, error) {
-	res := make([][]byte, 0)
-	rows, err := b.conn.Query("SELECT DISTINCT namespace FROM pieces")
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	defer rows.Close()
-	var ns []byte
-	for rows.Next() {
-		err := rows.Scan(&ns)
-		if err != nil {
-			return nil, err
-		}
-		res = append(res, ns)
-	}
-	return res, nil
+	return b.index.ListNamespaces(ctx)
 }
 
 func (b *LargeFileStore) WalkNamespace(ctx context.Context, namespace []byte, walkFunc func(blobstore.BlobInfo) error) error {
-	rows, err := b.conn.Query("SELECT namespace,key,size FROM pieces WHERE not trash AND namespace=$1", namespace)
+	return b.index.WalkNamespace(ctx, namespace, func(piece Piece) error {
+		return walkFunc(newBlobInfo(b.dir, piece))
+	})
+}
+
+// Names of the store level metadata which bind the database to the node and the store directory.
+const (
+	metaNodeID  = "node_id"
+	metaStoreID = "store_id"
+)
+
+// storeIDSize is the size of the random identifier of the store directory.
+const storeIDSize = 16
+
+// CreateVerificationFile writes the node ID and the identifier of the store directory to the
+// verification file, and binds the metadata database to them. The identifier of an existing
+// verification file is kept. A database bound to another node or another directory is refused.
+func (b *LargeFileStore) CreateVerificationFile(ctx context.Context, id storj.NodeID) error {
+	nodeID, storeID, err := b.binding(ctx)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		b := BlobInfo{
-			ref: blobstore.BlobRef{},
-		}
-		err = rows.Scan(&b.ref.Namespace, &b.ref.Key, &b.size)
+	if nodeID != "" && nodeID != id.String() {
+		return errs.New("metadata database belongs to another node (%s)", nodeID)
+	}
+
+	fileStoreID, err := b.readVerificationFile(id)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if storeID != "" && storeID != hex.EncodeToString(fileStoreID) {
+		return errs.New("metadata database belongs to another store directory (%s), not to %s", storeID, b.dir)
+	}
+
+	if fileStoreID == nil {
+		fileStoreID = make([]byte, storeIDSize)
+		_, err = rand.Read(fileStoreID)
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		err := walkFunc(b)
+		err = writeFileSync(filepath.Join(b.dir, verificationFileName), append(id.Bytes(), fileStoreID...))
 		if err != nil {
-			return errors.WithStack(err)
+			return err
 		}
+	}
+	return b.index.SetMetas(ctx, map[string]string{
+		metaNodeID:  id.String(),
+		metaStoreID: hex.EncodeToString(fileStoreID),
+	})
+}
 
+// VerifyStorageDir checks that the verification file of the store directory contains the node ID,
+// and the metadata database belongs to the same node and directory. A database without binding
+// (created before the verification) is bound to the directory.
+func (b *LargeFileStore) VerifyStorageDir(ctx context.Context, id storj.NodeID) error {
+	fileStoreID, err := b.readVerificationFile(id)
+	if err != nil {
+		return err
 	}
+	storeID := hex.EncodeToString(fileStoreID)
 
+	nodeID, dbStoreID, err := b.binding(ctx)
+	if err != nil {
+		return err
+	}
+	if nodeID != "" && nodeID != id.String() {
+		return errs.New("metadata database belongs to another node (%s), not to %s", nodeID, id)
+	}
+	if dbStoreID == "" {
+		return b.index.SetMetas(ctx, map[string]string{
+			metaNodeID:  id.String(),
+			metaStoreID: storeID,
+		})
+	}
+	if dbStoreID != storeID {
+		return errs.New("metadata database belongs to another store directory (%s), not to %s (%s)", dbStoreID, b.dir, storeID)
+	}
 	return nil
 }
 
-func (b *LargeFileStore) CreateVerificationFile(ctx context.Context, id storj.NodeID) error {
-	return nil
+// binding returns the node ID and the store ID the metadata database is bound to, empty if they are
+// not set.
+func (b *LargeFileStore) binding(ctx context.Context) (nodeID string, storeID string, err error) {
+	nodeID, err = b.index.GetMeta(ctx, metaNodeID)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", "", err
+	}
+	storeID, err = b.index.GetMeta(ctx, metaStoreID)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", "", err
+	}
+	return nodeID, storeID, nil
 }
 
-func (b *LargeFileStore) VerifyStorageDir(ctx context.Context, id storj.NodeID) error {
-	return nil
+// readVerificationFile returns the store ID of the verification file, which should belong to the
+// node. It returns os.ErrNotExist if there is no verification file.
+func (b *LargeFileStore) readVerificationFile(id storj.NodeID) ([]byte, error) {
+	content, err := os.ReadFile(filepath.Join(b.dir, verificationFileName))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(content) != len(id.Bytes())+storeIDSize {
+		return nil, errs.New("content of the verification file is invalid: %x", content)
+	}
+	fileNodeID, err := storj.NodeIDFromBytes(content[:len(id.Bytes())])
+	if err != nil {
+		return nil, errs.New("content of the verification file is not a valid node ID: %x", content)
+	}
+	if fileNodeID != id {
+		return nil, errs.New("node ID in file (%s) does not match running node's ID (%s)", fileNodeID, id)
+	}
+	return content[len(id.Bytes()):], nil
 }
 
 func (b *LargeFileStore) Close() error {
-	return b.conn.Close()
+	if b.stopCompaction != nil {
+		b.stopCompaction()
+		<-b.compactionDone
+	}
+	return errs.Combine(b.segments.Close(), b.files.Close(), b.access.Close(), b.index.Close(), errors.WithStack(b.lock.Close()))
 }
 
-func RefToFile(ref blobstore.BlobRef) string {
-	return filepath.Join(PathEncoding.EncodeToString(ref.Namespace), PathEncoding.EncodeToString(ref.Key)+".sj1")
+// syncFile flushes the file, unless syncing is turned off.
+func (b *LargeFileStore) syncFile(f *os.File) error {
+	if b.config.Sync == SyncNone {
+		return nil
+	}
+	return errors.WithStack(f.Sync())
 }
 
-func InitTable(conn *sql.DB) error {
-	_, err := conn.Exec("create table pieces (namespace BYTEA not null, key BYTEA not null, size int NOT NULL DEFAULT 0,trash bool not null default false,slot_id int not null,created timestamp not null default current_timestamp,accessed timestamp not null default current_timestamp,PRIMARY KEY(namespace, key))")
-	if err != nil {
-		return err
-	}
-	_, err = conn.Exec("create table slots (id serial primary key, file text NOT NULL, start int NOT NULL DEFAULT 0, size int NOT NULL DEFAULT 0)")
-	if err != nil {
-		return err
+// syncDir flushes the directory entries, unless syncing is turned off.
+func (b *LargeFileStore) syncDir(dir string) error {
+	if b.config.Sync == SyncNone {
+		return nil
 	}
-	return nil
+	return syncDir(dir)
+}
+
+func RefToFile(ref blobstore.BlobRef) string {
+	return filepath.Join(PathEncoding.EncodeToString(ref.Namespace), PathEncoding.EncodeToString(ref.Key)+".sj1")
 }
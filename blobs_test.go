@@ -1,11 +1,19 @@
 package largefile
 
 import (
+	"bytes"
 	"context"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/sys/unix"
 	"io"
+	"os"
+	"path/filepath"
+	"storj.io/common/memory"
+	"storj.io/common/testrand"
 	"storj.io/storj/storagenode/blobstore"
 	"testing"
+	"time"
 )
 
 func TestMoveToTrash(t *testing.T) {
@@ -73,6 +81,62 @@ func TestStat(t *testing.T) {
 	})
 }
 
+func TestBlobInfoLocation(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		data := map[string][]byte{}
+		for _, key := range []string{"key1", "key2", "key3"} {
+			data[key] = testrand.BytesInt(100 + len(data)*10)
+			ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte(key)}
+			w, err := store.Create(ctx, ref, int64(len(data[key])))
+			require.NoError(t, err)
+			_, err = w.Write(data[key])
+			require.NoError(t, err)
+			require.NoError(t, w.Commit(ctx))
+		}
+
+		check := func(info BlobInfo) {
+			expected := data[string(info.BlobRef().Key)]
+			require.Equal(t, int64(len(expected)), info.Size())
+			require.False(t, info.Created().IsZero())
+			trashed, _ := info.Trashed()
+			require.False(t, trashed)
+
+			path, err := info.FullPath(ctx)
+			require.NoError(t, err)
+			require.Equal(t, filepath.Join(store.dir, info.File()), path)
+			f, err := os.Open(path)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, f.Close()) }()
+			actual := make([]byte, len(expected))
+			_, err = f.ReadAt(actual, info.Offset())
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+
+			stat, err := info.Stat(ctx)
+			require.NoError(t, err)
+			require.Equal(t, filepath.Base(RefToFile(info.BlobRef())), stat.Name())
+			require.Equal(t, int64(len(expected)), stat.Size())
+			require.Equal(t, os.FileMode(0444), stat.Mode())
+			require.True(t, stat.Mode().IsRegular())
+			require.Equal(t, info.Created(), stat.ModTime())
+			require.Equal(t, info.Piece(), stat.Sys())
+		}
+
+		stat, err := store.Stat(ctx, blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("key2")})
+		require.NoError(t, err)
+		check(stat.(BlobInfo))
+
+		walked := 0
+		err = store.WalkNamespace(ctx, []byte("ns"), func(info blobstore.BlobInfo) error {
+			walked++
+			check(info.(BlobInfo))
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, len(data), walked)
+	})
+}
+
 func TestWriteWithSeek(t *testing.T) {
 	TestStores(t, func(ctx context.Context, t *testing.T, store blobstore.Blobs) {
 		ref1 := blobstore.BlobRef{
@@ -165,3 +229,395 @@ func rall(r io.Reader) ([]byte, error) {
 		}
 	}
 }
+
+func TestInterleavedWrites(t *testing.T) {
+	TestStores(t, func(ctx context.Context, t *testing.T, store blobstore.Blobs) {
+		hints := []int64{-1, 0, 5, 100, 2000}
+		writers := make([]blobstore.BlobWriter, len(hints))
+		refs := make([]blobstore.BlobRef, len(hints))
+		for i, hint := range hints {
+			refs[i] = blobstore.BlobRef{
+				Namespace: []byte("ns"),
+				Key:       []byte{byte(i)},
+			}
+			var err error
+			writers[i], err = store.Create(ctx, refs[i], hint)
+			require.NoError(t, err)
+		}
+
+		cancelled, err := store.Create(ctx, blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("cancelled")}, 10)
+		require.NoError(t, err)
+		_, err = cancelled.Write(bytes.Repeat([]byte{'x'}, 30))
+		require.NoError(t, err)
+
+		for round := 0; round < 10; round++ {
+			for i, w := range writers {
+				_, err := w.Write(bytes.Repeat([]byte{byte('a' + i)}, 10*(i+1)))
+				require.NoError(t, err)
+			}
+		}
+		require.NoError(t, cancelled.Cancel(ctx))
+		for _, w := range writers {
+			require.NoError(t, w.Commit(ctx))
+		}
+
+		for i, ref := range refs {
+			r, err := store.Open(ctx, ref)
+			require.NoError(t, err)
+			content, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.Equal(t, bytes.Repeat([]byte{byte('a' + i)}, 100*(i+1)), content)
+		}
+	})
+}
+
+func TestEmptyTrash(t *testing.T) {
+	TestStores(t, func(ctx context.Context, t *testing.T, store blobstore.Blobs) {
+		refs := []blobstore.BlobRef{
+			{Namespace: []byte("ns1"), Key: []byte("key1")},
+			{Namespace: []byte("ns1"), Key: []byte("key2")},
+			{Namespace: []byte("ns2"), Key: []byte("key3")},
+			{Namespace: []byte("ns1"), Key: []byte("key4")},
+		}
+		for _, ref := range refs {
+			out, err := store.Create(ctx, ref, 10)
+			require.NoError(t, err)
+			_, err = out.Write([]byte("1234567890"))
+			require.NoError(t, err)
+			require.NoError(t, out.Commit(ctx))
+		}
+		for _, ref := range refs[:3] {
+			require.NoError(t, store.Trash(ctx, ref))
+		}
+
+		emptied, keys, err := store.EmptyTrash(ctx, []byte("ns1"), time.Now().Add(-time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, int64(0), emptied)
+		require.Empty(t, keys)
+
+		emptied, keys, err = store.EmptyTrash(ctx, []byte("ns1"), time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, int64(20), emptied)
+		require.ElementsMatch(t, [][]byte{[]byte("key1"), []byte("key2")}, keys)
+
+		restored, err := store.RestoreTrash(ctx, []byte("ns1"))
+		require.NoError(t, err)
+		require.Empty(t, restored)
+		restored, err = store.RestoreTrash(ctx, []byte("ns2"))
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{[]byte("key3")}, restored)
+	})
+}
+
+func TestEmptyTrashReclaim(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("key")}
+		out, err := store.Create(ctx, ref, 10)
+		require.NoError(t, err)
+		_, err = out.Write([]byte("1234567890"))
+		require.NoError(t, err)
+		require.NoError(t, out.Commit(ctx))
+		piece, err := store.index.Get(ctx, ref)
+		require.NoError(t, err)
+		require.NoError(t, store.segments.Close())
+
+		require.NoError(t, store.Trash(ctx, ref))
+		used, err := store.SpaceUsedForTrash(ctx)
+		require.NoError(t, err)
+		require.Equal(t, int64(10), used)
+		used, err = store.SpaceUsedForTrashInNamespace(ctx, []byte("ns"))
+		require.NoError(t, err)
+		require.Equal(t, int64(10), used)
+		used, err = store.SpaceUsedForTrashInNamespace(ctx, []byte("other"))
+		require.NoError(t, err)
+		require.Equal(t, int64(0), used)
+
+		_, _, err = store.EmptyTrash(ctx, []byte("ns"), time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		_, err = os.Stat(filepath.Join(store.dir, piece.Slot.File))
+		require.True(t, os.IsNotExist(err))
+
+		report, err := store.Fsck(ctx, false)
+		require.NoError(t, err)
+		require.Equal(t, 0, report.Issues())
+	})
+}
+
+func TestDeleteNamespace(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		create := func(ref blobstore.BlobRef) Piece {
+			out, err := store.Create(ctx, ref, 10)
+			require.NoError(t, err)
+			_, err = out.Write([]byte("1234567890"))
+			require.NoError(t, err)
+			require.NoError(t, out.Commit(ctx))
+			piece, err := store.index.Get(ctx, ref)
+			require.NoError(t, err)
+			return piece
+		}
+
+		kept := create(blobstore.BlobRef{Namespace: []byte("ns2"), Key: []byte("key")})
+		create(blobstore.BlobRef{Namespace: []byte("ns1"), Key: []byte("key1")})
+		trashed := blobstore.BlobRef{Namespace: []byte("ns1"), Key: []byte("key2")}
+		create(trashed)
+		require.NoError(t, store.Trash(ctx, trashed))
+		require.NoError(t, store.segments.Close())
+		deleted := create(blobstore.BlobRef{Namespace: []byte("ns1"), Key: []byte("key3")})
+		require.NoError(t, store.segments.Close())
+		require.NotEqual(t, kept.Slot.File, deleted.Slot.File)
+
+		var reports []DeleteNamespaceProgress
+		err := store.DeleteNamespaceWithProgress(ctx, []byte("ns1"), func(progress DeleteNamespaceProgress) {
+			reports = append(reports, progress)
+		})
+		require.NoError(t, err)
+		require.NotEmpty(t, reports)
+		last := reports[len(reports)-1]
+		require.Equal(t, 3, last.Pieces)
+		require.Equal(t, int64(30), last.Bytes)
+		require.Equal(t, int64(30), last.TotalBytes)
+		require.Equal(t, 1, last.Files)
+
+		_, err = os.Stat(filepath.Join(store.dir, deleted.Slot.File))
+		require.True(t, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(store.dir, kept.Slot.File))
+		require.NoError(t, err)
+
+		namespaces, err := store.ListNamespaces(ctx)
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{[]byte("ns2")}, namespaces)
+		reader, err := store.Open(ctx, kept.Ref)
+		require.NoError(t, err)
+		content, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, []byte("1234567890"), content)
+		require.NoError(t, reader.Close())
+
+		report, err := store.Fsck(ctx, false)
+		require.NoError(t, err)
+		require.Equal(t, 0, report.Issues())
+	})
+}
+
+func TestDeleteReclaim(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		// imported from a filestore, the piece owns the whole file
+		standalone := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("standalone")}
+		require.NoError(t, os.WriteFile(filepath.Join(store.dir, "standalone.sj1"), []byte("1234567890"), 0644))
+		require.NoError(t, store.index.Insert(ctx, standalone, Slot{File: "standalone.sj1", Size: 10}))
+
+		var refs []blobstore.BlobRef
+		for i := 0; i < 2; i++ {
+			ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte{byte(i)}}
+			out, err := store.Create(ctx, ref, 10)
+			require.NoError(t, err)
+			_, err = out.Write([]byte("1234567890"))
+			require.NoError(t, err)
+			require.NoError(t, out.Commit(ctx))
+			refs = append(refs, ref)
+		}
+		shared, err := store.index.Get(ctx, refs[0])
+		require.NoError(t, err)
+
+		require.NoError(t, store.Delete(ctx, standalone))
+		_, err = os.Stat(filepath.Join(store.dir, "standalone.sj1"))
+		require.True(t, os.IsNotExist(err))
+
+		require.NoError(t, store.Delete(ctx, refs[0]))
+		usage, err := store.index.FileUsage(ctx)
+		require.NoError(t, err)
+		require.Equal(t, map[string]int64{shared.Slot.File: 10}, usage)
+		_, err = os.Stat(filepath.Join(store.dir, shared.Slot.File))
+		require.NoError(t, err)
+
+		report, err := store.Fsck(ctx, false)
+		require.NoError(t, err)
+		require.Equal(t, 0, report.Issues())
+	})
+}
+
+func TestRenameRef(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		refs := []blobstore.BlobRef{
+			{Namespace: []byte("ns"), Key: []byte("key1")},
+			{Namespace: []byte("ns"), Key: []byte("key2")},
+		}
+		contents := [][]byte{[]byte("1234567890"), []byte("abcdefghijklmnopqrst")}
+		for i, ref := range refs {
+			out, err := store.Create(ctx, ref, int64(len(contents[i])))
+			require.NoError(t, err)
+			_, err = out.Write(contents[i])
+			require.NoError(t, err)
+			require.NoError(t, out.Commit(ctx))
+		}
+		shared, err := store.index.Get(ctx, refs[1])
+		require.NoError(t, err)
+
+		require.NoError(t, store.RenameRef(ctx, refs[1], filepath.Join("renamed", "key2")))
+		raw, err := os.ReadFile(filepath.Join(store.dir, "renamed", "key2"))
+		require.NoError(t, err)
+		require.Equal(t, contents[1], raw)
+
+		require.NoError(t, store.RenameRef(ctx, refs[1], "key2"))
+		_, err = os.Stat(filepath.Join(store.dir, "renamed", "key2"))
+		require.True(t, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(store.dir, shared.Slot.File))
+		require.NoError(t, err)
+
+		for i, ref := range refs {
+			reader, err := store.Open(ctx, ref)
+			require.NoError(t, err)
+			content, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, contents[i], content)
+			require.NoError(t, reader.Close())
+		}
+
+		// the piece is no longer in its original slot
+		applied, err := store.index.Relocate(ctx, []Relocation{{Ref: refs[1], From: shared.Slot.ID, To: Slot{File: "stale"}}})
+		require.NoError(t, err)
+		require.Equal(t, 0, applied)
+
+		report, err := store.Fsck(ctx, false)
+		require.NoError(t, err)
+		require.Equal(t, 0, report.Issues())
+	})
+}
+
+func TestImport(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("key")}
+		data := testrand.BytesInt(100)
+		file := filepath.Join("imported", RefToFile(ref))
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(store.dir, file)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(store.dir, file), data, 0644))
+
+		require.Error(t, store.Import(ctx, ref, "missing"))
+		require.NoError(t, store.Import(ctx, ref, file))
+
+		reader, err := store.Open(ctx, ref)
+		require.NoError(t, err)
+		content, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, data, content)
+		require.NoError(t, reader.Close())
+	})
+}
+
+func TestFreeSpace(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		var stat unix.Statfs_t
+		require.NoError(t, unix.Statfs(store.dir, &stat))
+		available := int64(stat.Bavail) * int64(stat.Bsize) //nolint: unconvert
+
+		free, err := store.FreeSpace(ctx)
+		require.NoError(t, err)
+		require.InDelta(t, available-store.config.ReservedSpace.Int64(), free, float64(64*memory.MiB))
+
+		store.config.ReservedSpace = memory.Size(available * 2)
+		free, err = store.FreeSpace(ctx)
+		require.NoError(t, err)
+		require.Zero(t, free)
+	})
+}
+
+func TestReclaimableSpace(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		var refs []blobstore.BlobRef
+		for i := 0; i < 4; i++ {
+			ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte{byte(i)}}
+			out, err := store.Create(ctx, ref, 1000)
+			require.NoError(t, err)
+			_, err = out.Write(bytes.Repeat([]byte{1}, 100))
+			require.NoError(t, err)
+
+			space, err := store.ReclaimableSpace(ctx)
+			require.NoError(t, err)
+			require.Equal(t, int64(900), space.Reserved)
+
+			require.NoError(t, out.Commit(ctx))
+			refs = append(refs, ref)
+		}
+
+		// the active segment is not reclaimable
+		require.NoError(t, store.Delete(ctx, refs[0]))
+		space, err := store.ReclaimableSpace(ctx)
+		require.NoError(t, err)
+		require.Equal(t, ReclaimableSpace{}, space)
+
+		require.NoError(t, store.segments.Close())
+		space, err = store.ReclaimableSpace(ctx)
+		require.NoError(t, err)
+		require.Equal(t, ReclaimableSpace{Dead: 100}, space)
+
+		require.NoError(t, store.Delete(ctx, refs[1]))
+		space, err = store.ReclaimableSpace(ctx)
+		require.NoError(t, err)
+		require.Equal(t, ReclaimableSpace{Dead: 200, Compactable: 200}, space)
+
+		stats, err := store.Compact(ctx, store.config.Compaction.Threshold)
+		require.NoError(t, err)
+		require.Equal(t, 1, stats.Files)
+		space, err = store.ReclaimableSpace(ctx)
+		require.NoError(t, err)
+		require.Equal(t, ReclaimableSpace{}, space)
+	})
+}
+
+func TestVerifyStorageDir(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		require.NoError(t, store.CheckWritability(ctx))
+
+		id := testrand.NodeID()
+		require.Error(t, store.VerifyStorageDir(ctx, id))
+		require.NoError(t, store.CreateVerificationFile(ctx, id))
+		require.NoError(t, store.VerifyStorageDir(ctx, id))
+		// repeated, the identifier of the directory is kept
+		require.NoError(t, store.CreateVerificationFile(ctx, id))
+		require.NoError(t, store.VerifyStorageDir(ctx, id))
+		require.Error(t, store.VerifyStorageDir(ctx, testrand.NodeID()))
+		require.Error(t, store.CreateVerificationFile(ctx, testrand.NodeID()))
+	})
+
+	t.Run("other dir", func(t *testing.T) {
+		ctx := context.Background()
+		id := testrand.NodeID()
+		open := func(dir string, metadataDir string) *LargeFileStore {
+			config := testConfig("sqlite:", dir)
+			config.MetadataDir = metadataDir
+			store, err := NewBlobStore(zaptest.NewLogger(t), config)
+			require.NoError(t, err)
+			return store
+		}
+
+		dir1, dir2 := t.TempDir(), t.TempDir()
+		for _, dir := range []string{dir1, dir2} {
+			store := open(dir, dir)
+			require.NoError(t, store.CreateVerificationFile(ctx, id))
+			require.NoError(t, store.Close())
+		}
+
+		// mixed up databases, or a wrong disk, are not rebound
+		store := open(dir2, dir1)
+		require.Error(t, store.VerifyStorageDir(ctx, id))
+		require.Error(t, store.CreateVerificationFile(ctx, id))
+		require.Error(t, store.VerifyStorageDir(ctx, id))
+		require.NoError(t, store.Close())
+		store = open(t.TempDir(), dir1)
+		require.Error(t, store.CreateVerificationFile(ctx, id))
+		require.NoError(t, store.Close())
+		store = open(dir1, dir1)
+		require.NoError(t, store.VerifyStorageDir(ctx, id))
+		require.NoError(t, store.Close())
+
+		// a database without binding is bound at the first verification
+		metadataDir := t.TempDir()
+		store = open(dir2, metadataDir)
+		require.NoError(t, store.VerifyStorageDir(ctx, id))
+		require.NoError(t, store.Close())
+		store = open(dir1, metadataDir)
+		require.Error(t, store.VerifyStorageDir(ctx, id))
+		require.NoError(t, store.Close())
+	})
+}
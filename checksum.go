@@ -0,0 +1,94 @@
+package largefile
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/zeebo/errs"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"storj.io/storj/storagenode/blobstore"
+)
+
+// ErrCorruption is the class of the errors returned when the stored data doesn't match the checksum
+// recorded at commit.
+var ErrCorruption = errs.Class("corrupted piece")
+
+// checksumRange calculates the CRC32C checksum of a byte range of the file.
+func checksumRange(f *os.File, offset int64, size int64) (uint32, error) {
+	h := crc32.New(castagnoli)
+	n, err := io.Copy(h, io.NewSectionReader(f, offset, size))
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if n < size {
+		return 0, errors.WithStack(io.ErrUnexpectedEOF)
+	}
+	return h.Sum32(), nil
+}
+
+// OpenVerified opens the piece like Open, but reading it sequentially until the end returns an
+// ErrCorruption error instead of io.EOF if the data doesn't match the recorded checksum. Pieces
+// committed without a checksum are returned without verification.
+func (b *LargeFileStore) OpenVerified(ctx context.Context, ref blobstore.BlobRef) (blobstore.BlobReader, error) {
+	r, err := NewReader(ctx, b.index, b.files, b.access, ref)
+	if err != nil {
+		return nil, err
+	}
+	if r.checksum == nil {
+		return r, nil
+	}
+	return &verifyingReader{
+		reader:     r,
+		expected:   *r.checksum,
+		hash:       crc32.New(castagnoli),
+		sequential: true,
+	}, nil
+}
+
+// verifyingReader hashes the data while it's read from the beginning to the end. Seeking to another
+// position than the beginning or the current one, or reading with ReadAt turns off the verification.
+type verifyingReader struct {
+	*reader
+	expected   uint32
+	hash       hash.Hash32
+	hashed     int64
+	sequential bool
+}
+
+func (v *verifyingReader) Read(p []byte) (n int, err error) {
+	n, err = v.reader.Read(p)
+	if !v.sequential {
+		return n, err
+	}
+	_, _ = v.hash.Write(p[:n])
+	v.hashed += int64(n)
+	if err == io.EOF && v.hashed == v.size && v.hash.Sum32() != v.expected {
+		return n, ErrCorruption.New("checksum mismatch of piece in %s at %d (expected %08x, actual %08x)", v.source.Name(), v.offset, v.expected, v.hash.Sum32())
+	}
+	return n, err
+}
+
+func (v *verifyingReader) ReadAt(p []byte, off int64) (n int, err error) {
+	v.sequential = false
+	return v.reader.ReadAt(p, off)
+}
+
+func (v *verifyingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := v.reader.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	switch pos {
+	case v.hashed:
+		// position is not changed
+	case 0:
+		v.hash.Reset()
+		v.hashed = 0
+		v.sequential = true
+	default:
+		v.sequential = false
+	}
+	return pos, nil
+}
@@ -0,0 +1,97 @@
+package largefile
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"storj.io/common/testrand"
+	"storj.io/storj/storagenode/blobstore"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		// intact piece before the corrupted one
+		kept := blobstore.BlobRef{Namespace: []byte("ns"), Key: testrand.Bytes(32)}
+		w, err := store.Create(ctx, kept, 500)
+		require.NoError(t, err)
+		_, err = w.Write(testrand.BytesInt(500))
+		require.NoError(t, err)
+		require.NoError(t, w.Commit(ctx))
+
+		sequential := blobstore.BlobRef{Namespace: []byte("ns"), Key: testrand.Bytes(32)}
+		data := testrand.BytesInt(3000)
+		w, err = store.Create(ctx, sequential, int64(len(data)))
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Commit(ctx))
+
+		// header written at the end, as the piece store does
+		seeking := blobstore.BlobRef{Namespace: []byte("ns"), Key: testrand.Bytes(32)}
+		w, err = store.Create(ctx, seeking, int64(len(data)))
+		require.NoError(t, err)
+		_, err = w.Seek(100, io.SeekStart)
+		require.NoError(t, err)
+		_, err = w.Write(data[100:])
+		require.NoError(t, err)
+		_, err = w.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		_, err = w.Write(data[:100])
+		require.NoError(t, err)
+		_, err = w.Seek(0, io.SeekEnd)
+		require.NoError(t, err)
+		require.NoError(t, w.Commit(ctx))
+
+		for _, ref := range []blobstore.BlobRef{sequential, seeking} {
+			piece, err := store.index.Get(ctx, ref)
+			require.NoError(t, err)
+			require.NotNil(t, piece.Slot.Checksum)
+			require.Equal(t, crc32.Checksum(data, castagnoli), *piece.Slot.Checksum)
+
+			reader, err := store.OpenVerified(ctx, ref)
+			require.NoError(t, err)
+			content, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, data, content)
+			require.NoError(t, reader.Close())
+		}
+
+		// flip one byte of the first piece
+		piece, err := store.index.Get(ctx, sequential)
+		require.NoError(t, err)
+		f, err := os.OpenFile(filepath.Join(store.dir, piece.Slot.File), os.O_RDWR, 0644)
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte{data[10] ^ 0xff}, piece.Slot.Start+10)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		reader, err := store.OpenVerified(ctx, sequential)
+		require.NoError(t, err)
+		_, err = io.ReadAll(reader)
+		require.True(t, ErrCorruption.Has(err))
+		require.NoError(t, reader.Close())
+
+		// the corrupted piece is not moved by the compaction
+		require.NoError(t, store.segments.Close())
+		require.NoError(t, store.Delete(ctx, seeking))
+		stats, err := store.Compact(ctx, 0.3)
+		require.NoError(t, err)
+		require.Equal(t, 1, stats.Corrupted)
+		require.Equal(t, 1, stats.Moved)
+		moved, err := store.index.Get(ctx, sequential)
+		require.NoError(t, err)
+		require.Equal(t, piece.Slot, moved.Slot)
+
+		// the copy of the corrupted piece doesn't remain in the new file
+		moved, err = store.index.Get(ctx, kept)
+		require.NoError(t, err)
+		require.NotEqual(t, piece.Slot.File, moved.Slot.File)
+		stat, err := os.Stat(filepath.Join(store.dir, moved.Slot.File))
+		require.NoError(t, err)
+		require.Equal(t, int64(500), stat.Size())
+	})
+}
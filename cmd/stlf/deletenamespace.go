@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	largefile "github.com/elek/storj-largefile-storage"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func init() {
+	cmd := cobra.Command{
+		Use: "delete-namespace",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return deleteNamespace(args[0], args[1])
+		},
+	}
+	RootCmd.AddCommand(&cmd)
+
+}
+
+func deleteNamespace(dir string, namespaceHex string) error {
+	namespace, err := hex.DecodeString(namespaceHex)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	store, err := openStore(zap.NewNop(), dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	return store.DeleteNamespaceWithProgress(context.Background(), namespace, func(progress largefile.DeleteNamespaceProgress) {
+		fmt.Printf("deleted pieces: %d, bytes: %d/%d, removed files: %d\n", progress.Pieces, progress.Bytes, progress.TotalBytes, progress.Files)
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func init() {
+	var repair bool
+	cmd := cobra.Command{
+		Use: "fsck",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return fsck(args[0], repair)
+		},
+	}
+	cmd.Flags().BoolVar(&repair, "repair", false, "remove the orphaned segment files and the unused slots")
+	RootCmd.AddCommand(&cmd)
+
+}
+
+func fsck(dir string, repair bool) error {
+	store, err := openStore(zap.NewNop(), dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := store.Fsck(context.Background(), repair)
+	if err != nil {
+		return err
+	}
+	for _, file := range report.OrphanedFiles {
+		fmt.Println("orphaned file:", file)
+	}
+	for _, slot := range report.MissingFiles {
+		fmt.Printf("missing file: slot %d, %s\n", slot.ID, slot.File)
+	}
+	for _, slot := range report.PastEOF {
+		fmt.Printf("past EOF: slot %d, %s [%d, %d)\n", slot.ID, slot.File, slot.Start, slot.Start+slot.Size)
+	}
+	for _, slot := range report.UnusedSlots {
+		fmt.Printf("unused slot: slot %d, %s [%d, %d)\n", slot.ID, slot.File, slot.Start, slot.Start+slot.Size)
+	}
+	for _, overlap := range report.Overlaps {
+		fmt.Printf("overlapping slots: %d and %d, %s\n", overlap[0].ID, overlap[1].ID, overlap[1].File)
+	}
+	fmt.Printf("issues: %d, removed files: %d, deleted slots: %d\n", report.Issues(), report.RemovedFiles, report.DeletedSlots)
+	return nil
+}
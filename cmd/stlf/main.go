@@ -1,8 +1,11 @@
 package main
 
 import (
+	largefile "github.com/elek/storj-largefile-storage"
 	"github.com/spf13/cobra"
+	"go.uber.org/zap"
 	"log"
+	"os"
 )
 
 var RootCmd = cobra.Command{
@@ -15,3 +18,15 @@ func main() {
 		log.Fatalf("%++v", err)
 	}
 }
+
+// openStore opens the store of the directory with the metadata backend of STORJ_LARGEFILE_CONN, as
+// the instance of STORJ_LARGEFILE_INSTANCE.
+func openStore(log *zap.Logger, dir string) (*largefile.LargeFileStore, error) {
+	config := largefile.DefaultConfig
+	config.Connection = os.Getenv("STORJ_LARGEFILE_CONN")
+	config.Instance = os.Getenv("STORJ_LARGEFILE_INSTANCE")
+	config.Dir = dir
+	// the commands are short-lived, compaction has its own command
+	config.Compaction.Disabled = true
+	return largefile.NewBlobStore(log, config)
+}
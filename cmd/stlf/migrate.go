@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	largefile "github.com/elek/storj-largefile-storage"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func init() {
+	var statusOnly bool
+	cmd := cobra.Command{
+		Use: "migrate",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir := ""
+			if len(args) > 0 {
+				dir = args[0]
+			}
+			return migrate(dir, statusOnly)
+		},
+	}
+	cmd.Flags().BoolVar(&statusOnly, "status", false, "only print the status of the schema")
+	RootCmd.AddCommand(&cmd)
+
+}
+
+func migrate(dir string, statusOnly bool) error {
+	ctx := context.Background()
+	index, err := largefile.ConnectIndex(os.Getenv("STORJ_LARGEFILE_CONN"), dir, os.Getenv("STORJ_LARGEFILE_INSTANCE"))
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	status, err := index.SchemaStatus(ctx)
+	if err != nil {
+		return err
+	}
+	printSchemaStatus(status)
+	if statusOnly || len(status.Pending) == 0 {
+		return nil
+	}
+
+	err = index.Migrate(ctx)
+	if err != nil {
+		return err
+	}
+	status, err = index.SchemaStatus(ctx)
+	if err != nil {
+		return err
+	}
+	printSchemaStatus(status)
+	return nil
+}
+
+func printSchemaStatus(status largefile.SchemaStatus) {
+	fmt.Printf("schema version: %d (latest: %d)\n", status.Current, status.Latest)
+	for _, step := range status.Pending {
+		fmt.Printf("  pending: %s\n", step)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	largefile "github.com/elek/storj-largefile-storage"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"time"
+)
+
+func init() {
+	var config largefile.ScrubConfig
+	var continuous bool
+	cmd := cobra.Command{
+		Use: "scrub",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return scrub(args[0], config, continuous)
+		},
+	}
+	cmd.Flags().Int64Var(&config.BytesPerSecond, "rate", 0, "maximum read throughput in bytes per second (0: unlimited)")
+	cmd.Flags().Float64Var(&config.Sample, "sample", 0, "probability of verifying a piece (0: verify all of them)")
+	cmd.Flags().StringVar(&config.ProgressFile, "progress", "", "file to save the progress, an interrupted pass is continued from there")
+	cmd.Flags().BoolVar(&config.Quarantine, "quarantine", false, "move the failed pieces to the quarantine directory and delete them")
+	cmd.Flags().BoolVar(&continuous, "continuous", false, "start a new pass when the previous one is finished")
+	RootCmd.AddCommand(&cmd)
+
+}
+
+func scrub(dir string, config largefile.ScrubConfig, continuous bool) error {
+	ctx := context.Background()
+	log, err := zap.NewDevelopment()
+	if err != nil {
+		return err
+	}
+	store, err := openStore(log, dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	for {
+		stats, err := store.Scrub(ctx, log, config)
+		if err != nil {
+			return err
+		}
+		for _, failure := range stats.Failed {
+			fmt.Println(hex.EncodeToString(failure.Piece.Ref.Namespace), hex.EncodeToString(failure.Piece.Ref.Key), failure.Err)
+		}
+		fmt.Printf("checked: %d, skipped: %d, without checksum: %d, bytes: %d, failed: %d\n", stats.Checked, stats.Skipped, stats.Unverified, stats.Bytes, len(stats.Failed))
+		if !continuous {
+			return nil
+		}
+		if stats.Checked+stats.Skipped == 0 {
+			time.Sleep(time.Minute)
+		}
+	}
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/hex"
 	"fmt"
-	"github.com/pkg/errors"
+	largefile "github.com/elek/storj-largefile-storage"
 	"github.com/spf13/cobra"
 	"os"
 )
@@ -13,32 +13,31 @@ func init() {
 	cmd := cobra.Command{
 		Use: "stat",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return stat()
+			dir := ""
+			if len(args) > 0 {
+				dir = args[0]
+			}
+			return stat(dir)
 		},
 	}
 	RootCmd.AddCommand(&cmd)
 
 }
 
-func stat() error {
-	c := os.Getenv("STORJ_LARGEFILE_CONN")
-	conn, err := sql.Open("pgx", c)
+func stat(dir string) error {
+	ctx := context.Background()
+	index, err := largefile.OpenIndex(ctx, os.Getenv("STORJ_LARGEFILE_CONN"), dir, os.Getenv("STORJ_LARGEFILE_INSTANCE"))
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
-	defer conn.Close()
+	defer index.Close()
 
-	rows, err := conn.Query("SELECT distinct namespace from pieces")
+	namespaces, err := index.ListNamespaces(ctx)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
 
-	var namespace []byte
-	for rows.Next() {
-		err = rows.Scan(&namespace)
-		if err != nil {
-			return errors.WithStack(err)
-		}
+	for _, namespace := range namespaces {
 		fmt.Println(hex.EncodeToString(namespace))
 
 	}
@@ -0,0 +1,434 @@
+package largefile
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/zeebo/errs"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"sort"
+	"storj.io/common/sync2"
+	"strings"
+	"time"
+)
+
+// CompactionConfig defines when the segment files are compacted in the background.
+type CompactionConfig struct {
+	// Disabled turns off the background compaction, the files are compacted only by explicit Compact
+	// calls.
+	Disabled bool          `help:"don't compact the segment files in the background" default:"false"`
+	Interval time.Duration `help:"time between two compaction runs" default:"1h"`
+	// Threshold is the minimum ratio of dead bytes (not used by any piece) to compact a file.
+	Threshold float64 `help:"minimum ratio of dead bytes to compact a segment file" default:"0.5"`
+}
+
+// DefaultCompactionConfig is the default value of CompactionConfig.
+var DefaultCompactionConfig = CompactionConfig{
+	Interval:  time.Hour,
+	Threshold: 0.5,
+}
+
+// CompactionStats summarizes one compaction run.
+type CompactionStats struct {
+	Files int
+	Moved int
+	Freed int64
+	// Corrupted is the number of pieces which are not moved as they don't match their checksum.
+	Corrupted int
+}
+
+// runCompaction compacts the files of the store at startup and periodically (as configured), until
+// the context is canceled. It's started by NewBlobStore, unless the compaction is disabled.
+func (b *LargeFileStore) runCompaction(ctx context.Context) {
+	log := b.log
+	cycle := sync2.NewCycle(b.config.Compaction.Interval)
+	defer cycle.Close()
+	_ = cycle.Run(ctx, func(ctx context.Context) error {
+		stats, err := b.Compact(ctx, b.config.Compaction.Threshold)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error("compaction is failed", zap.Error(err))
+			}
+			return nil
+		}
+		if stats.Corrupted > 0 {
+			log.Warn("corrupted pieces are not compacted", zap.Int("pieces", stats.Corrupted))
+		}
+		if stats.Files > 0 {
+			log.Info("files are compacted", zap.Int("files", stats.Files), zap.Int("moved", stats.Moved), zap.Int64("freed", stats.Freed))
+		}
+		return nil
+	})
+}
+
+type compactionCandidate struct {
+	file string
+	size int64
+	live int64
+}
+
+// Compact copies the live pieces of the files with more dead bytes than the threshold to a new
+// segment, and removes the old files.
+func (b *LargeFileStore) Compact(ctx context.Context, threshold float64) (stats CompactionStats, err error) {
+	b.compactionMu.Lock()
+	defer b.compactionMu.Unlock()
+
+	candidates, err := b.compactionCandidates(ctx, threshold)
+	if err != nil || len(candidates) == 0 {
+		return stats, err
+	}
+
+	dest, err := b.segments.create()
+	if err != nil {
+		return stats, err
+	}
+	var written int64
+	defer func() {
+		b.segments.release(dest, written)
+		if written == 0 {
+			_ = os.Remove(filepath.Join(b.dir, dest.seg.name))
+		}
+	}()
+
+	var moves []Relocation
+	var compacted []compactionCandidate
+	for _, candidate := range candidates {
+		if written > 0 && written+candidate.live > maxSegmentSize {
+			break
+		}
+		fileMoves, corrupted, err := b.copyLive(ctx, candidate.file, dest, &written)
+		if err != nil {
+			return stats, err
+		}
+		stats.Corrupted += corrupted
+		moves = append(moves, fileMoves...)
+		compacted = append(compacted, candidate)
+	}
+
+	// the new copies should be persisted before anything points to them
+	if written > 0 {
+		err = b.syncFile(dest.seg.file)
+		if err != nil {
+			return stats, err
+		}
+		err = b.syncDir(filepath.Join(b.dir, segmentDir))
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	stats.Moved, err = b.index.Relocate(ctx, moves)
+	if err != nil {
+		return stats, err
+	}
+
+	for _, candidate := range compacted {
+		removed, err := b.removeUnused(ctx, candidate.file)
+		if err != nil {
+			return stats, err
+		}
+		if removed {
+			stats.Files++
+			stats.Freed += candidate.size
+		}
+	}
+	stats.Freed -= written
+	return stats, nil
+}
+
+// compactionCandidates returns the files over the threshold, with the most dead bytes first.
+func (b *LargeFileStore) compactionCandidates(ctx context.Context, threshold float64) ([]compactionCandidate, error) {
+	files, err := b.sealedFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []compactionCandidate
+	for _, file := range files {
+		if file.overThreshold(threshold) {
+			candidates = append(candidates, file)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].size-candidates[i].live > candidates[j].size-candidates[j].live
+	})
+	return candidates, nil
+}
+
+// overThreshold returns true if the file should be compacted: it's unused, or the ratio of its dead
+// bytes reaches the threshold.
+func (c compactionCandidate) overThreshold(threshold float64) bool {
+	dead := c.size - c.live
+	return c.live == 0 || (dead > 0 && float64(dead)/float64(c.size) >= threshold)
+}
+
+// sealedFiles returns the allocated size and the live bytes of the files which are not written anymore. Only
+// the files with slots are returned: a segment without any slot may be the active segment of
+// another process (e.g. the node, while stlf runs), the orphaned ones are removed by fsck.
+func (b *LargeFileStore) sealedFiles(ctx context.Context) ([]compactionCandidate, error) {
+	usage, err := b.index.FileUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []compactionCandidate
+	for file, live := range usage {
+		if b.segments.inUse(file) {
+			continue
+		}
+		stat, err := os.Stat(filepath.Join(b.dir, file))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.WithStack(err)
+		}
+		files = append(files, compactionCandidate{
+			file: file,
+			size: allocatedSize(stat),
+			live: live,
+		})
+	}
+	return files, nil
+}
+
+// copyLive appends all the pieces of the file to the destination segment. Pieces which don't match
+// their checksum are left in place (and the file is kept).
+func (b *LargeFileStore) copyLive(ctx context.Context, file string, dest *region, written *int64) (moves []Relocation, corrupted int, err error) {
+	var source *os.File
+	defer func() {
+		if source != nil {
+			err = errs.Combine(err, source.Close())
+		}
+	}()
+	err = b.index.WalkFile(ctx, file, func(piece Piece) error {
+		if source == nil {
+			f, err := os.Open(filepath.Join(b.dir, file))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			source = f
+		}
+		checksum, err := copyRange(dest.seg.file, *written, source, piece.Slot.Start, piece.Slot.Size)
+		if err != nil {
+			return err
+		}
+		if piece.Slot.Checksum != nil && *piece.Slot.Checksum != checksum {
+			// drop the copy, it would remain as dead bytes after the last piece
+			corrupted++
+			return errors.WithStack(dest.seg.file.Truncate(*written))
+		}
+		moves = append(moves, Relocation{
+			Ref:  piece.Ref,
+			From: piece.Slot.ID,
+			To: Slot{
+				File:     dest.seg.name,
+				Start:    *written,
+				Size:     piece.Slot.Size,
+				Checksum: piece.Slot.Checksum,
+			},
+		})
+		*written += piece.Slot.Size
+		return nil
+	})
+	return moves, corrupted, err
+}
+
+// RemoveUnusedFiles deletes the files (and their slots) which have no non-trashed piece, except the
+// segments being written. Files which still store trashed pieces are kept, as the pieces can be
+// restored. It returns the number of removed files.
+func (b *LargeFileStore) RemoveUnusedFiles(ctx context.Context) (removed int, err error) {
+	files, err := b.index.UnusedFiles(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var group errs.Group
+	for _, file := range files {
+		if b.segments.inUse(file) {
+			continue
+		}
+		ok, err := b.removeUnused(ctx, file)
+		group.Add(err)
+		if ok {
+			removed++
+		}
+	}
+	return removed, group.Err()
+}
+
+// removeUnused deletes the file (and the remaining slots) if no piece is stored in it.
+func (b *LargeFileStore) removeUnused(ctx context.Context, file string) (bool, error) {
+	used, err := b.index.FileInUse(ctx, file)
+	if err != nil || used {
+		return false, err
+	}
+	err = b.index.DeleteSlots(ctx, file)
+	if err != nil {
+		return false, err
+	}
+	b.files.evict(file)
+	err = os.Remove(filepath.Join(b.dir, file))
+	if err != nil && !os.IsNotExist(err) {
+		return false, errors.WithStack(err)
+	}
+	return true, nil
+}
+
+// compactionBatch is the number of pieces switched to the new file in one transaction.
+const compactionBatch = 1000
+
+// compactionMarkerExt is the suffix of the file which records an unfinished CompactInto.
+const compactionMarkerExt = ".compacting"
+
+// CompactInto copies all the non-trashed pieces into the newName file and removes the files which
+// become unused. The pieces are switched to the new file in batches, each batch only after the
+// copied data is synced. The source files of the switched batches are recorded in a marker file:
+// if the marker exists, the previous (interrupted) run is continued. Pieces which don't match their
+// checksum are not moved, and reported with an ErrCorruption error at the end.
+func (b *LargeFileStore) CompactInto(ctx context.Context, newName string) (err error) {
+	b.compactionMu.Lock()
+	defer b.compactionMu.Unlock()
+
+	destPath := filepath.Join(b.dir, newName)
+	markerPath := destPath + compactionMarkerExt
+
+	sources := map[string]bool{}
+	var end int64
+	raw, err := os.ReadFile(markerPath)
+	switch {
+	case err == nil:
+		for _, line := range strings.Split(string(raw), "\n") {
+			if line != "" {
+				sources[line] = true
+			}
+		}
+		// everything after the last switched piece belongs to an unfinished batch
+		err = b.index.WalkFile(ctx, newName, func(piece Piece) error {
+			if piece.Slot.Start+piece.Slot.Size > end {
+				end = piece.Slot.Start + piece.Slot.Size
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	case os.IsNotExist(err):
+		if _, err = os.Stat(destPath); err == nil {
+			return errs.New("File already exists.")
+		}
+	default:
+		return errors.WithStack(err)
+	}
+
+	marker, err := os.OpenFile(markerPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		err = errs.Combine(err, marker.Close())
+	}()
+	dest, err := os.OpenFile(destPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		err = errs.Combine(err, dest.Close())
+	}()
+	err = dest.Truncate(end)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = b.syncDir(filepath.Dir(destPath))
+	if err != nil {
+		return err
+	}
+
+	var batch []Relocation
+	var batchSources []string
+	corrupted := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		for _, source := range batchSources {
+			if _, err := marker.WriteString(source + "\n"); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if err := b.syncFile(marker); err != nil {
+			return err
+		}
+		if err := b.syncFile(dest); err != nil {
+			return err
+		}
+		if _, err := b.index.Relocate(ctx, batch); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		batchSources = batchSources[:0]
+		return nil
+	}
+
+	err = b.index.WalkPieces(ctx, func(piece Piece) error {
+		if piece.Slot.File == newName {
+			return nil
+		}
+		source, err := os.Open(filepath.Join(b.dir, piece.Slot.File))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		checksum, err := copyRange(dest, end, source, piece.Slot.Start, piece.Slot.Size)
+		err = errs.Combine(err, source.Close())
+		if err != nil {
+			return err
+		}
+		if piece.Slot.Checksum != nil && *piece.Slot.Checksum != checksum {
+			corrupted++
+			return errors.WithStack(dest.Truncate(end))
+		}
+
+		batch = append(batch, Relocation{
+			Ref:  piece.Ref,
+			From: piece.Slot.ID,
+			To: Slot{
+				File:     newName,
+				Start:    end,
+				Size:     piece.Slot.Size,
+				Checksum: piece.Slot.Checksum,
+			},
+		})
+		end += piece.Slot.Size
+		if !sources[piece.Slot.File] {
+			sources[piece.Slot.File] = true
+			batchSources = append(batchSources, piece.Slot.File)
+		}
+		if len(batch) >= compactionBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = flush()
+	if err != nil {
+		return err
+	}
+
+	for source := range sources {
+		if source == newName || b.segments.inUse(source) {
+			continue
+		}
+		if _, err := b.removeUnused(ctx, source); err != nil {
+			return err
+		}
+	}
+	err = os.Remove(markerPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if corrupted > 0 {
+		return ErrCorruption.New("%d pieces don't match their checksum and remained in the original files", corrupted)
+	}
+	return nil
+}
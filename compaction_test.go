@@ -0,0 +1,271 @@
+package largefile
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"io"
+	"os"
+	"path/filepath"
+	"storj.io/common/testrand"
+	"storj.io/storj/storagenode/blobstore"
+	"testing"
+	"time"
+)
+
+func TestCompaction(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		var refs []blobstore.BlobRef
+		var contents [][]byte
+		for i := 0; i < 20; i++ {
+			ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: testrand.Bytes(32)}
+			data := testrand.BytesInt(1000 + i)
+			w, err := store.Create(ctx, ref, int64(len(data)))
+			require.NoError(t, err)
+			_, err = w.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, w.Commit(ctx))
+			refs = append(refs, ref)
+			contents = append(contents, data)
+		}
+		piece, err := store.index.Get(ctx, refs[0])
+		require.NoError(t, err)
+		oldSegment := piece.Slot.File
+
+		// nothing to do while the segment is active
+		stats, err := store.Compact(ctx, 0.5)
+		require.NoError(t, err)
+		require.Equal(t, 0, stats.Files)
+
+		// a segment without slots may be written by another process, it's left to fsck
+		unknown := filepath.Join(store.dir, segmentDir, "00000000000000ff"+segmentExt)
+		require.NoError(t, os.WriteFile(unknown, []byte("written by another process"), 0644))
+		defer func() {
+			_, err := os.Stat(unknown)
+			require.NoError(t, err)
+		}()
+
+		require.NoError(t, store.segments.Close())
+		for i := range refs {
+			if i%3 != 0 {
+				require.NoError(t, store.Delete(ctx, refs[i]))
+			}
+		}
+		require.NoError(t, store.Trash(ctx, refs[3]))
+
+		// opened before the compaction, should be readable even after the file is removed
+		reader, err := store.Open(ctx, refs[0])
+		require.NoError(t, err)
+
+		stats, err = store.Compact(ctx, 0.5)
+		require.NoError(t, err)
+		require.Equal(t, 1, stats.Files)
+		require.Equal(t, 7, stats.Moved)
+
+		_, err = os.Stat(filepath.Join(store.dir, oldSegment))
+		require.True(t, os.IsNotExist(err))
+
+		content, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, contents[0], content)
+		require.NoError(t, reader.Close())
+
+		_, err = store.RestoreTrash(ctx, []byte("ns"))
+		require.NoError(t, err)
+		for i := range refs {
+			if i%3 != 0 {
+				continue
+			}
+			reader, err := store.Open(ctx, refs[i])
+			require.NoError(t, err)
+			content, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(contents[i], content))
+			require.NoError(t, reader.Close())
+		}
+	})
+}
+
+func TestCompactInto(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		contents := map[string][]byte{}
+		for i := 0; i < 10; i++ {
+			ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: testrand.Bytes(32)}
+			data := testrand.BytesInt(100 + i)
+			w, err := store.Create(ctx, ref, -1)
+			require.NoError(t, err)
+			_, err = w.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, w.Commit(ctx))
+			contents[string(ref.Key)] = data
+		}
+		require.NoError(t, store.segments.Close())
+
+		require.NoError(t, os.WriteFile(filepath.Join(store.dir, "combined"), []byte("garbage"), 0644))
+		require.Error(t, store.CompactInto(ctx, "combined"))
+
+		// interrupted run: the marker exists, but nothing is switched yet
+		require.NoError(t, os.WriteFile(filepath.Join(store.dir, "combined"+compactionMarkerExt), nil, 0644))
+		require.NoError(t, store.CompactInto(ctx, "combined"))
+
+		_, err := os.Stat(filepath.Join(store.dir, "combined"+compactionMarkerExt))
+		require.True(t, os.IsNotExist(err))
+		entries, err := os.ReadDir(filepath.Join(store.dir, segmentDir))
+		require.NoError(t, err)
+		require.Len(t, entries, 0)
+
+		stat, err := os.Stat(filepath.Join(store.dir, "combined"))
+		require.NoError(t, err)
+		require.Equal(t, int64(10*100+45), stat.Size())
+
+		for key, data := range contents {
+			reader, err := store.Open(ctx, blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte(key)})
+			require.NoError(t, err)
+			content, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, data, content)
+			require.NoError(t, reader.Close())
+		}
+
+		// rerun after a crash before the marker is removed
+		require.NoError(t, os.WriteFile(filepath.Join(store.dir, "combined"+compactionMarkerExt), nil, 0644))
+		require.NoError(t, store.CompactInto(ctx, "combined"))
+		stat, err = os.Stat(filepath.Join(store.dir, "combined"))
+		require.NoError(t, err)
+		require.Equal(t, int64(10*100+45), stat.Size())
+	})
+}
+
+func TestBackgroundCompaction(t *testing.T) {
+	ctx := context.Background()
+	config := testConfig("memory:", t.TempDir())
+	config.Compaction.Disabled = false
+	config.Compaction.Interval = 10 * time.Millisecond
+	store, err := NewBlobStore(zaptest.NewLogger(t), config)
+	require.NoError(t, err)
+
+	var refs []blobstore.BlobRef
+	for i := 0; i < 10; i++ {
+		ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: testrand.Bytes(32)}
+		w, err := store.Create(ctx, ref, 1000)
+		require.NoError(t, err)
+		_, err = w.Write(testrand.BytesInt(1000))
+		require.NoError(t, err)
+		require.NoError(t, w.Commit(ctx))
+		refs = append(refs, ref)
+	}
+	piece, err := store.index.Get(ctx, refs[0])
+	require.NoError(t, err)
+	require.NoError(t, store.segments.Close())
+	for _, ref := range refs[1:] {
+		require.NoError(t, store.Delete(ctx, ref))
+	}
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(store.dir, piece.Slot.File))
+		return os.IsNotExist(err)
+	}, 10*time.Second, 10*time.Millisecond)
+
+	reader, err := store.Open(ctx, refs[0])
+	require.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Len(t, content, 1000)
+	require.NoError(t, reader.Close())
+
+	// Close stops the loop
+	require.NoError(t, store.Close())
+	select {
+	case <-store.compactionDone:
+	default:
+		t.Fatal("compaction is still running")
+	}
+}
+
+func TestRemoveUnusedFiles(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		trashed := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("trashed")}
+		require.NoError(t, os.WriteFile(filepath.Join(store.dir, "trashed"), []byte("data"), 0644))
+		require.NoError(t, store.index.Insert(ctx, trashed, Slot{File: "trashed", Size: 4}))
+		require.NoError(t, store.Trash(ctx, trashed))
+
+		deleted := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("deleted")}
+		require.NoError(t, os.WriteFile(filepath.Join(store.dir, "deleted"), []byte("data"), 0644))
+		require.NoError(t, store.index.Insert(ctx, deleted, Slot{File: "deleted", Size: 4}))
+		// the old slot is left behind
+		require.NoError(t, store.index.MoveSlot(ctx, deleted, Slot{File: "moved", Size: 4}))
+
+		// the file of the slot is already gone
+		missing := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("missing")}
+		require.NoError(t, store.index.Insert(ctx, missing, Slot{File: "missing", Size: 4}))
+		require.NoError(t, store.index.MoveSlot(ctx, missing, Slot{File: "moved", Start: 4, Size: 4}))
+
+		removed, err := store.RemoveUnusedFiles(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 2, removed)
+
+		_, err = os.Stat(filepath.Join(store.dir, "trashed"))
+		require.NoError(t, err)
+		_, err = os.Stat(filepath.Join(store.dir, "deleted"))
+		require.True(t, os.IsNotExist(err))
+		_, err = store.RestoreTrash(ctx, []byte("ns"))
+		require.NoError(t, err)
+		_, err = store.Open(ctx, trashed)
+		require.NoError(t, err)
+	})
+}
+
+func TestFileInUse(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		inUse := func(file string) bool {
+			used, err := store.index.FileInUse(ctx, file)
+			require.NoError(t, err)
+			return used
+		}
+		ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("key")}
+		require.False(t, inUse("a"))
+		require.NoError(t, store.index.Insert(ctx, ref, Slot{File: "a", Size: 10}))
+		require.True(t, inUse("a"))
+
+		// trashed pieces keep the file
+		require.NoError(t, store.index.Trash(ctx, ref))
+		require.True(t, inUse("a"))
+		_, err := store.index.RestoreTrash(ctx, ref.Namespace)
+		require.NoError(t, err)
+
+		piece, err := store.index.Get(ctx, ref)
+		require.NoError(t, err)
+		applied, err := store.index.Relocate(ctx, []Relocation{{Ref: ref, From: piece.Slot.ID, To: Slot{File: "b", Size: 10}}})
+		require.NoError(t, err)
+		require.Equal(t, 1, applied)
+		require.False(t, inUse("a"))
+		require.True(t, inUse("b"))
+
+		_, err = store.index.Delete(ctx, ref)
+		require.NoError(t, err)
+		require.False(t, inUse("b"))
+	})
+}
+
+func TestRelocateStale(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("key")}
+		require.NoError(t, store.index.Insert(ctx, ref, Slot{File: "a", Size: 10}))
+		piece, err := store.index.Get(ctx, ref)
+		require.NoError(t, err)
+		// the old slot is left behind
+		require.NoError(t, store.index.MoveSlot(ctx, ref, Slot{File: "b", Size: 10}))
+
+		applied, err := store.index.Relocate(ctx, []Relocation{{Ref: ref, From: piece.Slot.ID, To: Slot{File: "c", Size: 10}}})
+		require.NoError(t, err)
+		require.Equal(t, 0, applied)
+
+		var files []string
+		require.NoError(t, store.index.WalkSlots(ctx, func(slot Slot, piece *Piece) error {
+			files = append(files, slot.File)
+			return nil
+		}))
+		require.Equal(t, []string{"a", "b"}, files)
+	})
+}
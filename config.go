@@ -0,0 +1,109 @@
+package largefile
+
+import (
+	"github.com/zeebo/errs"
+	"storj.io/common/memory"
+	"time"
+)
+
+// ErrInvalidConfig is the error class of the rejected configurations.
+var ErrInvalidConfig = errs.Class("invalid config")
+
+// SyncMode defines when the written pieces are flushed to the disk.
+type SyncMode string
+
+const (
+	// SyncNone leaves the flushing to the operating system, a crash may lose the committed pieces.
+	SyncNone SyncMode = "none"
+	// SyncCommit flushes the data of each piece before its commit returns.
+	SyncCommit SyncMode = "commit"
+	// SyncBatch flushes the data before the commit returns, but the concurrent commits wait for each
+	// other (at most SyncDelay) to share the flush of a segment.
+	SyncBatch SyncMode = "batch"
+)
+
+// String implements pflag.Value.
+func (m *SyncMode) String() string {
+	return string(*m)
+}
+
+// Set implements pflag.Value.
+func (m *SyncMode) Set(value string) error {
+	mode := SyncMode(value)
+	switch mode {
+	case SyncNone, SyncCommit, SyncBatch:
+		*m = mode
+		return nil
+	}
+	return ErrInvalidConfig.New("unknown sync mode %q (none, commit or batch)", value)
+}
+
+// Type implements pflag.Value.
+func (m *SyncMode) Type() string {
+	return "sync-mode"
+}
+
+// Config is the configuration of the store.
+type Config struct {
+	Connection  string `help:"metadata backend: postgres connection string, sqlite:<path>, log:<path> or memory:" default:"sqlite:"`
+	Dir         string `help:"directory of the segment files" default:""`
+	MetadataDir string `help:"directory of the sqlite and log metadata (relative paths of the connection are resolved here), the store directory if empty" default:""`
+	Instance    string `help:"identifier of the store in a metadata database shared by several stores" default:""`
+
+	Sync      SyncMode      `help:"flushing of the committed pieces: none, commit or batch (concurrent commits share the flush)" default:"commit"`
+	SyncDelay time.Duration `help:"maximum time a batched commit waits for the others" default:"10ms"`
+
+	ReservedSpace memory.Size `help:"disk space which is not reported as free" default:"1GiB"`
+
+	FileCacheSize int  `help:"maximum number of segment files kept open for the readers" default:"256"`
+	Mmap          bool `help:"serve the pieces of the sealed segments from memory mapped files" default:"false"`
+
+	Compaction CompactionConfig
+	AccessTime AccessTimeConfig
+}
+
+// DefaultConfig is the default value of Config, without the store directory.
+var DefaultConfig = Config{
+	Connection:    "sqlite:",
+	Sync:          SyncCommit,
+	SyncDelay:     10 * time.Millisecond,
+	ReservedSpace: memory.GiB,
+	FileCacheSize: defaultFileCacheSize,
+	Compaction:    DefaultCompactionConfig,
+	AccessTime:    DefaultAccessTimeConfig,
+}
+
+// Validate returns the problems of the configuration.
+func (c Config) Validate() error {
+	var group errs.Group
+	if c.Connection == "" {
+		group.Add(ErrInvalidConfig.New("connection is empty"))
+	}
+	if c.Dir == "" {
+		group.Add(ErrInvalidConfig.New("store directory is empty"))
+	}
+	switch c.Sync {
+	case SyncNone, SyncCommit, SyncBatch:
+	default:
+		group.Add(ErrInvalidConfig.New("unknown sync mode %q", c.Sync))
+	}
+	if c.SyncDelay < 0 {
+		group.Add(ErrInvalidConfig.New("negative sync delay"))
+	}
+	if c.ReservedSpace < 0 {
+		group.Add(ErrInvalidConfig.New("negative reserved space"))
+	}
+	if c.FileCacheSize <= 0 {
+		group.Add(ErrInvalidConfig.New("file cache size should be positive"))
+	}
+	if !c.Compaction.Disabled && c.Compaction.Interval <= 0 {
+		group.Add(ErrInvalidConfig.New("compaction interval should be positive"))
+	}
+	if c.Compaction.Threshold <= 0 || c.Compaction.Threshold > 1 {
+		group.Add(ErrInvalidConfig.New("compaction threshold should be in (0, 1]"))
+	}
+	if c.AccessTime.Interval < 0 || c.AccessTime.Granularity < 0 {
+		group.Add(ErrInvalidConfig.New("negative access time interval or granularity"))
+	}
+	return group.Err()
+}
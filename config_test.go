@@ -0,0 +1,88 @@
+package largefile
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"storj.io/common/testrand"
+	"storj.io/private/cfgstruct"
+	"storj.io/storj/storagenode/blobstore"
+	"sync"
+	"testing"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	var config Config
+	cfgstruct.Bind(pflag.NewFlagSet("test", pflag.PanicOnError), &config, cfgstruct.UseReleaseDefaults())
+	require.Equal(t, DefaultConfig, config)
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := testConfig("memory:", t.TempDir())
+	require.NoError(t, config.Validate())
+	// the interval is not used without the background compaction
+	disabled := config
+	disabled.Compaction.Interval = 0
+	require.NoError(t, disabled.Validate())
+
+	for name, modify := range map[string]func(*Config){
+		"no dir":       func(c *Config) { c.Dir = "" },
+		"sync mode":    func(c *Config) { c.Sync = "always" },
+		"cache size":   func(c *Config) { c.FileCacheSize = 0 },
+		"threshold":    func(c *Config) { c.Compaction.Threshold = 2 },
+		"interval":     func(c *Config) { c.Compaction.Disabled, c.Compaction.Interval = false, 0 },
+		"reserved":     func(c *Config) { c.ReservedSpace = -1 },
+		"access times": func(c *Config) { c.AccessTime.Granularity = -1 },
+	} {
+		invalid := config
+		modify(&invalid)
+		_, err := NewBlobStore(zaptest.NewLogger(t), invalid)
+		require.True(t, ErrInvalidConfig.Has(err), name)
+	}
+
+	var mode SyncMode
+	require.NoError(t, mode.Set("batch"))
+	require.Equal(t, SyncBatch, mode)
+	require.Error(t, mode.Set("always"))
+}
+
+func TestSyncModes(t *testing.T) {
+	ctx := context.Background()
+	for _, mode := range []SyncMode{SyncNone, SyncCommit, SyncBatch} {
+		t.Run(string(mode), func(t *testing.T) {
+			config := testConfig("memory:", t.TempDir())
+			config.Sync = mode
+			store, err := NewBlobStore(zaptest.NewLogger(t), config)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, store.Close()) }()
+
+			var wg sync.WaitGroup
+			errs := make([]error, 10)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					w, err := store.Create(ctx, blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte(fmt.Sprintf("piece%d", i))}, 100)
+					if err != nil {
+						errs[i] = err
+						return
+					}
+					if _, err = w.Write(testrand.BytesInt(100)); err != nil {
+						errs[i] = err
+						return
+					}
+					errs[i] = w.Commit(ctx)
+				}(i)
+			}
+			wg.Wait()
+			for _, err := range errs {
+				require.NoError(t, err)
+			}
+			used, err := store.SpaceUsedForBlobs(ctx)
+			require.NoError(t, err)
+			require.Equal(t, int64(1000), used)
+		})
+	}
+}
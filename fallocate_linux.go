@@ -0,0 +1,49 @@
+//go:build linux
+
+package largefile
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"os"
+	"syscall"
+)
+
+// preallocate allocates the disk blocks of the range, extending the file if needed. File systems
+// without fallocate support are ignored, but a full disk is reported.
+func preallocate(f *os.File, off int64, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	err := unix.Fallocate(int(f.Fd()), 0, off, size)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return nil
+	}
+	return errors.WithStack(err)
+}
+
+// deallocate frees the disk blocks of the range, which reads back as zeroes. The size of the file
+// is not changed.
+func deallocate(f *os.File, off int64, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, size)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return nil
+	}
+	return errors.WithStack(err)
+}
+
+// allocatedSize returns the bytes of the file which use disk space: the punched holes are not
+// counted, neither the rounding to the last block.
+func allocatedSize(stat os.FileInfo) int64 {
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return stat.Size()
+	}
+	if sys.Blocks*512 < stat.Size() {
+		return sys.Blocks * 512
+	}
+	return stat.Size()
+}
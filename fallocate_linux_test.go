@@ -0,0 +1,77 @@
+//go:build linux
+
+package largefile
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"storj.io/common/testrand"
+	"storj.io/storj/storagenode/blobstore"
+	"syscall"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		allocated := func(name string) int64 {
+			stat, err := os.Stat(filepath.Join(store.dir, name))
+			require.NoError(t, err)
+			return stat.Sys().(*syscall.Stat_t).Blocks * 512
+		}
+
+		ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("piece")}
+		w, err := store.Create(ctx, ref, 10<<20)
+		require.NoError(t, err)
+		name := w.(*writer).region.seg.name
+		if allocated(name) < 10<<20 {
+			t.Skip("fallocate is not supported by the file system")
+		}
+
+		data := testrand.BytesInt(1000)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Commit(ctx))
+		require.Less(t, allocated(name), int64(1<<20))
+
+		// the released tail is cut when the segment is sealed
+		require.NoError(t, store.segments.Close())
+		stat, err := os.Stat(filepath.Join(store.dir, name))
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), stat.Size())
+
+		r, err := store.Open(ctx, ref)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, r.Close()) }()
+		read := make([]byte, len(data))
+		_, err = r.ReadAt(read, 0)
+		require.NoError(t, err)
+		require.Equal(t, data, read)
+	})
+}
+
+func TestReclaimableSpaceHoles(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		// two pieces with a hole between them
+		f, err := os.Create(filepath.Join(store.dir, "sparse"))
+		require.NoError(t, err)
+		_, err = f.WriteAt(testrand.BytesInt(1000), 0)
+		require.NoError(t, err)
+		_, err = f.WriteAt(testrand.BytesInt(1000), 1<<20)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		stat, err := os.Stat(filepath.Join(store.dir, "sparse"))
+		require.NoError(t, err)
+		if stat.Sys().(*syscall.Stat_t).Blocks*512 >= stat.Size() {
+			t.Skip("sparse files are not supported by the file system")
+		}
+
+		require.NoError(t, store.index.Insert(ctx, blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("first")}, Slot{File: "sparse", Size: 1000}))
+		require.NoError(t, store.index.Insert(ctx, blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("second")}, Slot{File: "sparse", Start: 1 << 20, Size: 1000}))
+
+		space, err := store.ReclaimableSpace(ctx)
+		require.NoError(t, err)
+		require.Less(t, space.Dead, int64(1<<16))
+	})
+}
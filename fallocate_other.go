@@ -0,0 +1,22 @@
+//go:build !linux
+
+package largefile
+
+import (
+	"os"
+)
+
+// preallocate is not supported on this platform, the blocks are allocated by the writes.
+func preallocate(f *os.File, off int64, size int64) error {
+	return nil
+}
+
+// deallocate is not supported on this platform, the unused bytes remain allocated.
+func deallocate(f *os.File, off int64, size int64) error {
+	return nil
+}
+
+// allocatedSize returns the size of the file, as no hole is punched on this platform.
+func allocatedSize(stat os.FileInfo) int64 {
+	return stat.Size()
+}
@@ -0,0 +1,206 @@
+package largefile
+
+import (
+	"container/list"
+	"github.com/pkg/errors"
+	"github.com/spacemonkeygo/monkit/v3"
+	"github.com/zeebo/errs"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+)
+
+var mon = monkit.Package()
+
+// defaultFileCacheSize is the maximum number of files kept open by the file cache.
+const defaultFileCacheSize = 256
+
+// fileCache shares the open (read-only) files between the readers, which use positional reads only.
+// The files are reference counted: the unused ones stay open until the cache is full (least recently
+// used are closed first) or the file is removed. If all the cached files are in use, the new files
+// are opened outside of the cache.
+type fileCache struct {
+	mu     sync.Mutex
+	dir    string
+	limit  int
+	files  map[string]*cachedFile
+	unused *list.List
+	hits   int64
+	misses int64
+	// sealed returns true for the files which can be memory mapped, nil if mmap is disabled.
+	sealed func(name string) bool
+}
+
+type cachedFile struct {
+	name string
+	file *os.File
+	refs int
+	// elem is the position in the unused list, nil if the file is used.
+	elem *list.Element
+	// detached files are not part of the cache, and closed when the last reference is released.
+	detached bool
+	// data is the read-only mapping of the file (as it was at open), nil if the file is not mapped.
+	data []byte
+}
+
+func newFileCache(dir string, limit int) *fileCache {
+	return &fileCache{
+		dir:    dir,
+		limit:  limit,
+		files:  map[string]*cachedFile{},
+		unused: list.New(),
+	}
+}
+
+// open returns the file, which should be released after use.
+func (c *fileCache) open(name string) (*cachedFile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, found := c.files[name]; found {
+		c.hits++
+		mon.Counter("file_cache_hits").Inc(1)
+		if f.elem != nil {
+			c.unused.Remove(f.elem)
+			f.elem = nil
+		}
+		f.refs++
+		return f, nil
+	}
+	c.misses++
+	mon.Counter("file_cache_misses").Inc(1)
+
+	file, err := os.Open(filepath.Join(c.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	f := &cachedFile{
+		name: name,
+		file: file,
+		refs: 1,
+	}
+	if c.sealed != nil && c.sealed(name) {
+		f.data, err = mmapFile(file)
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	for len(c.files) >= c.limit && c.unused.Len() > 0 {
+		c.closeLocked(c.unused.Front().Value.(*cachedFile))
+	}
+	if len(c.files) >= c.limit {
+		f.detached = true
+		return f, nil
+	}
+	c.files[name] = f
+	mon.IntVal("file_cache_open").Observe(int64(len(c.files)))
+	return f, nil
+}
+
+func (c *fileCache) release(f *cachedFile) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f.refs <= 0 {
+		return errs.New("file %s is released more times than opened", f.name)
+	}
+	f.refs--
+	if f.refs > 0 {
+		return nil
+	}
+	if f.detached {
+		return f.close()
+	}
+	f.elem = c.unused.PushBack(f)
+	return nil
+}
+
+// evict removes the file from the cache, as it's deleted or replaced. Readers using the file can
+// continue reading the old content.
+func (c *fileCache) evict(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, found := c.files[name]; found {
+		c.closeLocked(f)
+	}
+}
+
+// closeLocked removes the file from the cache, and closes it if it's unused.
+func (c *fileCache) closeLocked(f *cachedFile) {
+	delete(c.files, f.name)
+	mon.IntVal("file_cache_open").Observe(int64(len(c.files)))
+	if f.elem != nil {
+		c.unused.Remove(f.elem)
+		f.elem = nil
+	}
+	if f.refs > 0 {
+		f.detached = true
+		return
+	}
+	_ = f.close()
+}
+
+// setMmap enables (or disables with nil) memory mapping of the files opened after the call. Only the
+// files reported as sealed are mapped, as a mapping doesn't follow the growth of the file.
+func (c *fileCache) setMmap(sealed func(name string) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sealed = sealed
+}
+
+// Close closes the unused files, the used ones are closed when they are released.
+func (c *fileCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range c.files {
+		c.closeLocked(f)
+	}
+	return nil
+}
+
+func (f *cachedFile) close() error {
+	var err error
+	if f.data != nil {
+		err = unix.Munmap(f.data)
+		f.data = nil
+	}
+	return errs.Combine(errors.WithStack(err), errors.WithStack(f.file.Close()))
+}
+
+// readMapped copies the bytes at off from the mapping. It returns false if the range is not mapped or
+// the file is truncated in the meantime (which would be SIGBUS without the recovered fault).
+func (f *cachedFile) readMapped(p []byte, off int64) (ok bool) {
+	if off < 0 || off+int64(len(p)) > int64(len(f.data)) {
+		return false
+	}
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			if _, fault := r.(interface{ Addr() uintptr }); !fault {
+				panic(r)
+			}
+			mon.Counter("mmap_faults").Inc(1)
+			ok = false
+		}
+	}()
+	copy(p, f.data[off:])
+	return true
+}
+
+// mmapFile maps the whole file read-only. Empty files are not mapped.
+func mmapFile(file *os.File) ([]byte, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if stat.Size() == 0 || stat.Size() != int64(int(stat.Size())) {
+		return nil, nil
+	}
+	data, err := unix.Mmap(int(file.Fd()), 0, int(stat.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return data, nil
+}
@@ -0,0 +1,114 @@
+package largefile
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"storj.io/common/testrand"
+	"storj.io/storj/storagenode/blobstore"
+	"testing"
+)
+
+func TestFileCache(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(name), 0644))
+	}
+	cache := newFileCache(dir, 2)
+	defer func() { require.NoError(t, cache.Close()) }()
+
+	a1, err := cache.open("a")
+	require.NoError(t, err)
+	a2, err := cache.open("a")
+	require.NoError(t, err)
+	require.Same(t, a1, a2)
+	require.Equal(t, int64(1), cache.hits)
+	require.Equal(t, int64(1), cache.misses)
+
+	b, err := cache.open("b")
+	require.NoError(t, err)
+
+	// all the cached files are in use
+	c, err := cache.open("c")
+	require.NoError(t, err)
+	require.True(t, c.detached)
+	require.NoError(t, cache.release(c))
+	require.Len(t, cache.files, 2)
+
+	// the least recently used one is closed
+	require.NoError(t, cache.release(a1))
+	require.NoError(t, cache.release(a2))
+	require.NoError(t, cache.release(b))
+	c, err = cache.open("c")
+	require.NoError(t, err)
+	require.False(t, c.detached)
+	require.NotContains(t, cache.files, "a")
+	require.Contains(t, cache.files, "b")
+
+	// replaced while in use
+	cache.evict("c")
+	require.NoError(t, os.Remove(filepath.Join(dir, "c")))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "c"), []byte("new"), 0644))
+	buf := make([]byte, 1)
+	_, err = c.file.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("c"), buf)
+	require.NoError(t, cache.release(c))
+
+	c, err = cache.open("c")
+	require.NoError(t, err)
+	buf = make([]byte, 3)
+	_, err = c.file.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), buf)
+	require.NoError(t, cache.release(c))
+
+	// released too many times
+	unused := cache.unused.Len()
+	require.Error(t, cache.release(c))
+	require.Equal(t, unused, cache.unused.Len())
+}
+
+func TestMmapReader(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		store.SetMmap(true)
+		ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("piece")}
+		data := testrand.BytesInt(10000)
+		w, err := store.Create(ctx, ref, int64(len(data)))
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Commit(ctx))
+
+		// the active segment is still written
+		r, err := store.Open(ctx, ref)
+		require.NoError(t, err)
+		active := r.(*reader).cached
+		require.Nil(t, active.data)
+		require.NoError(t, r.Close())
+		store.files.evict(active.name)
+
+		require.NoError(t, store.segments.Close())
+		r, err = store.Open(ctx, ref)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, r.Close()) }()
+		cached := r.(*reader).cached
+		require.NotNil(t, cached.data)
+
+		read, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, read)
+		buf := make([]byte, 100)
+		_, err = r.ReadAt(buf, 5000)
+		require.NoError(t, err)
+		require.Equal(t, data[5000:5100], buf)
+
+		// truncated under the mapping: the read falls back to the file instead of SIGBUS
+		require.NoError(t, os.Truncate(filepath.Join(store.dir, cached.name), 0))
+		n, err := r.ReadAt(buf, 5000)
+		require.Equal(t, 0, n)
+		require.ErrorIs(t, err, io.EOF)
+	})
+}
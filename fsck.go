@@ -0,0 +1,117 @@
+package largefile
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FsckReport lists the inconsistencies between the index and the files of the store.
+type FsckReport struct {
+	// OrphanedFiles are the segment files without any slot.
+	OrphanedFiles []string
+	// MissingFiles are the slots pointing to a file which doesn't exist.
+	MissingFiles []Slot
+	// PastEOF are the slots which end after the end of their file.
+	PastEOF []Slot
+	// UnusedSlots are the slots without any (trashed or not) piece.
+	UnusedSlots []Slot
+	// Overlaps are the pairs of slots sharing bytes of the same file.
+	Overlaps [][2]Slot
+
+	// RemovedFiles and DeletedSlots are the number of repaired issues.
+	RemovedFiles int
+	DeletedSlots int
+}
+
+// Issues returns the number of the found inconsistencies.
+func (r FsckReport) Issues() int {
+	return len(r.OrphanedFiles) + len(r.MissingFiles) + len(r.PastEOF) + len(r.UnusedSlots) + len(r.Overlaps)
+}
+
+// Fsck compares the slots of the index with the files. With repair, the orphaned segment files are
+// removed (if they still have no piece) and the unused slots are deleted. Missing data and
+// overlapping slots are only reported, as pieces may be lost with them. Other processes can't write
+// the store meanwhile, as the store dir is locked by the open store.
+func (b *LargeFileStore) Fsck(ctx context.Context, repair bool) (report FsckReport, err error) {
+	known := map[string]bool{}
+	sizes := map[string]int64{}
+	var last Slot
+	var lastEnd int64
+	err = b.index.WalkSlots(ctx, func(slot Slot, piece *Piece) error {
+		if !known[slot.File] {
+			known[slot.File] = true
+			stat, err := os.Stat(filepath.Join(b.dir, slot.File))
+			switch {
+			case err == nil:
+				sizes[slot.File] = stat.Size()
+			case os.IsNotExist(err):
+				sizes[slot.File] = -1
+			default:
+				return errors.WithStack(err)
+			}
+			last = Slot{}
+			lastEnd = 0
+		}
+
+		if piece == nil {
+			report.UnusedSlots = append(report.UnusedSlots, slot)
+		}
+		switch size := sizes[slot.File]; {
+		case size < 0:
+			report.MissingFiles = append(report.MissingFiles, slot)
+		case slot.Start+slot.Size > size:
+			report.PastEOF = append(report.PastEOF, slot)
+		}
+		if slot.Size > 0 {
+			if slot.Start < lastEnd {
+				report.Overlaps = append(report.Overlaps, [2]Slot{last, slot})
+			}
+			if slot.Start+slot.Size > lastEnd {
+				last = slot
+				lastEnd = slot.Start + slot.Size
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(b.dir, segmentDir))
+	if err != nil && !os.IsNotExist(err) {
+		return report, errors.WithStack(err)
+	}
+	for _, entry := range entries {
+		name := filepath.Join(segmentDir, entry.Name())
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) || known[name] || b.segments.inUse(name) {
+			continue
+		}
+		report.OrphanedFiles = append(report.OrphanedFiles, name)
+	}
+
+	if !repair {
+		return report, nil
+	}
+	for _, file := range report.OrphanedFiles {
+		// the file may have got pieces since the walk
+		if b.segments.inUse(file) {
+			continue
+		}
+		removed, err := b.removeUnused(ctx, file)
+		if err != nil {
+			return report, err
+		}
+		if removed {
+			report.RemovedFiles++
+		}
+	}
+	var unused []int64
+	for _, slot := range report.UnusedSlots {
+		unused = append(unused, slot.ID)
+	}
+	report.DeletedSlots, err = b.index.DeleteUnusedSlots(ctx, unused)
+	return report, err
+}
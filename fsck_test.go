@@ -0,0 +1,78 @@
+package largefile
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"os"
+	"path/filepath"
+	"storj.io/common/testrand"
+	"storj.io/storj/storagenode/blobstore"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		var refs []blobstore.BlobRef
+		for i := 0; i < 5; i++ {
+			ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: testrand.Bytes(32)}
+			data := testrand.BytesInt(1000)
+			w, err := store.Create(ctx, ref, int64(len(data)))
+			require.NoError(t, err)
+			_, err = w.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, w.Commit(ctx))
+			refs = append(refs, ref)
+		}
+		report, err := store.Fsck(ctx, false)
+		require.NoError(t, err)
+		require.Equal(t, 0, report.Issues())
+
+		last, err := store.index.Get(ctx, refs[4])
+		require.NoError(t, err)
+		// the old slot is left behind
+		first, err := store.index.Get(ctx, refs[0])
+		require.NoError(t, err)
+		require.NoError(t, store.index.MoveSlot(ctx, refs[0], Slot{File: first.Slot.File, Start: first.Slot.Start, Size: first.Slot.Size}))
+		require.NoError(t, os.WriteFile(filepath.Join(store.dir, segmentDir, "00000000000000ff"+segmentExt), []byte("orphan"), 0644))
+		require.NoError(t, store.index.Insert(ctx, blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("missing")}, Slot{File: "missing", Size: 10}))
+		require.NoError(t, store.index.Insert(ctx, blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("eof")}, Slot{File: last.Slot.File, Start: last.Slot.Start + 500, Size: 1000}))
+
+		report, err = store.Fsck(ctx, false)
+		require.NoError(t, err)
+		require.Equal(t, []string{filepath.Join(segmentDir, "00000000000000ff"+segmentExt)}, report.OrphanedFiles)
+		require.Len(t, report.UnusedSlots, 1)
+		require.Len(t, report.MissingFiles, 1)
+		require.Len(t, report.PastEOF, 1)
+		require.Len(t, report.Overlaps, 2)
+		require.Equal(t, first.Slot.ID, report.Overlaps[0][0].ID)
+		require.Equal(t, last.Slot.ID, report.Overlaps[1][0].ID)
+
+		report, err = store.Fsck(ctx, true)
+		require.NoError(t, err)
+		require.Equal(t, 1, report.RemovedFiles)
+		require.Equal(t, 1, report.DeletedSlots)
+
+		report, err = store.Fsck(ctx, false)
+		require.NoError(t, err)
+		require.Empty(t, report.OrphanedFiles)
+		require.Empty(t, report.UnusedSlots)
+		require.Len(t, report.MissingFiles, 1)
+		require.Len(t, report.PastEOF, 1)
+		require.Len(t, report.Overlaps, 1)
+	})
+}
+
+func TestStoreDirLock(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewBlobStore(zaptest.NewLogger(t), testConfig("memory:", dir))
+	require.NoError(t, err)
+
+	_, err = NewBlobStore(zaptest.NewLogger(t), testConfig("memory:", dir))
+	require.Error(t, err)
+
+	require.NoError(t, store.Close())
+	store, err = NewBlobStore(zaptest.NewLogger(t), testConfig("memory:", dir))
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+}
@@ -0,0 +1,162 @@
+package largefile
+
+import (
+	"context"
+	"path/filepath"
+	"storj.io/storj/storagenode/blobstore"
+	"strings"
+	"time"
+)
+
+// Slot is a byte range of a file inside the store directory.
+type Slot struct {
+	ID    int64
+	File  string
+	Start int64
+	Size  int64
+	// Checksum is the CRC32C of the data, nil if it's unknown (committed by an older version).
+	Checksum *uint32
+}
+
+// Piece is the metadata of one stored blob.
+type Piece struct {
+	Ref   blobstore.BlobRef
+	Size  int64
+	Trash bool
+	// TrashedAt is the time when the piece was moved to the trash.
+	TrashedAt time.Time
+	Created   time.Time
+	Accessed  time.Time
+	Slot      Slot
+}
+
+// Relocation moves a piece from its current slot to a new one.
+type Relocation struct {
+	Ref  blobstore.BlobRef
+	From int64
+	To   Slot
+}
+
+// Index is the metadata backend of the pieces and their slots.
+type Index interface {
+	// SchemaStatus returns the version of the schema, or an error if it's not usable by this code.
+	SchemaStatus(ctx context.Context) (SchemaStatus, error)
+	// Migrate applies the pending migration steps.
+	Migrate(ctx context.Context) error
+
+	// GetMeta returns a value of the store level metadata, or os.ErrNotExist.
+	GetMeta(ctx context.Context, name string) (string, error)
+	// SetMetas atomically saves values of the store level metadata.
+	SetMetas(ctx context.Context, values map[string]string) error
+
+	// Insert saves the slot and the piece atomically.
+	Insert(ctx context.Context, ref blobstore.BlobRef, slot Slot) error
+	// Get returns the non-trashed piece or os.ErrNotExist.
+	Get(ctx context.Context, ref blobstore.BlobRef) (Piece, error)
+	// Touch updates the access times of the (trashed or not) pieces, missing pieces are ignored.
+	Touch(ctx context.Context, accesses []Access) error
+	// Delete deletes the (trashed or not) piece together with its slot, and returns the deleted
+	// piece, if any.
+	Delete(ctx context.Context, ref blobstore.BlobRef) ([]Piece, error)
+	// DeleteNamespace deletes at most limit (trashed or not) pieces of the namespace, together with
+	// their slots, and returns the deleted pieces.
+	DeleteNamespace(ctx context.Context, namespace []byte, limit int) ([]Piece, error)
+
+	// Trash moves the piece to the trash and records the current time.
+	Trash(ctx context.Context, ref blobstore.BlobRef) error
+	// RestoreTrash restores the trashed pieces of the namespace and returns their keys.
+	RestoreTrash(ctx context.Context, namespace []byte) ([][]byte, error)
+	// EmptyTrash deletes the pieces of the namespace trashed before the given time, together with
+	// their slots, and returns the deleted pieces.
+	EmptyTrash(ctx context.Context, namespace []byte, trashedBefore time.Time) ([]Piece, error)
+
+	SpaceUsedForTrash(ctx context.Context) (int64, error)
+	SpaceUsedForTrashInNamespace(ctx context.Context, namespace []byte) (int64, error)
+	SpaceUsedForBlobs(ctx context.Context) (int64, error)
+	SpaceUsedForBlobsInNamespace(ctx context.Context, namespace []byte) (int64, error)
+
+	ListNamespaces(ctx context.Context) ([][]byte, error)
+	// WalkNamespace visits the non-trashed pieces of the namespace, with their slots.
+	WalkNamespace(ctx context.Context, namespace []byte, fn func(Piece) error) error
+	// WalkPieces visits all the non-trashed pieces of all namespaces.
+	WalkPieces(ctx context.Context, fn func(Piece) error) error
+
+	// MoveSlot points the piece to a new slot.
+	MoveSlot(ctx context.Context, ref blobstore.BlobRef, slot Slot) error
+	// UnusedFiles returns the files without any non-trashed piece.
+	UnusedFiles(ctx context.Context) ([]string, error)
+	DeleteSlots(ctx context.Context, file string) error
+
+	// FileUsage returns the bytes of each file which are referenced by a (trashed or not) piece.
+	FileUsage(ctx context.Context) (map[string]int64, error)
+	// FileInUse returns true if any (trashed or not) piece is stored in the file.
+	FileInUse(ctx context.Context, file string) (bool, error)
+	// WalkFile visits all the pieces stored in a file, in physical order.
+	WalkFile(ctx context.Context, file string, fn func(Piece) error) error
+	// ListSlots returns at most limit non-trashed pieces in physical order (by file, start and slot
+	// id), after the position of the given slot.
+	ListSlots(ctx context.Context, after Slot, limit int) ([]Piece, error)
+	// WalkSlots visits all the slots ordered by file, start and id, with the (trashed or not) piece
+	// stored in it, or nil if the slot is unused.
+	WalkSlots(ctx context.Context, fn func(slot Slot, piece *Piece) error) error
+	// DeleteUnusedSlots deletes the slots which are not used by any piece, and returns the number
+	// of deleted slots.
+	DeleteUnusedSlots(ctx context.Context, ids []int64) (int, error)
+	// Relocate atomically points the pieces to their new slots and removes the old slots, and
+	// returns the number of moved pieces. Pieces which are no longer stored in the From slot are not
+	// modified.
+	Relocate(ctx context.Context, moves []Relocation) (int, error)
+
+	Close() error
+}
+
+// OpenIndex opens the metadata backend defined by connDef and migrates the schema to the latest
+// version. It fails if the schema is half-initialized or newer than the supported version.
+func OpenIndex(ctx context.Context, connDef string, dir string, instance string) (Index, error) {
+	index, err := ConnectIndex(connDef, dir, instance)
+	if err != nil {
+		return nil, err
+	}
+	err = index.Migrate(ctx)
+	if err != nil {
+		_ = index.Close()
+		return nil, err
+	}
+	return index, nil
+}
+
+// ConnectIndex opens the metadata backend defined by connDef without checking or modifying the
+// schema. Connection strings starting with `sqlite:` use a local SQLite database (relative paths
+// are resolved in the store dir), `log:` uses the database-free append-only log of the store dir
+// (or the given dir), `memory:` keeps everything in memory (for tests), everything else is handled
+// as a Postgres connection string. The SQL backends see only the rows of the instance, so several
+// stores can share one database; the log and memory backends belong to one store anyway.
+func ConnectIndex(connDef string, dir string, instance string) (Index, error) {
+	var index Index
+	var err error
+	switch {
+	case connDef == "memory:":
+		index = newMemIndex()
+	case strings.HasPrefix(connDef, "log:"):
+		path := strings.TrimPrefix(strings.TrimPrefix(connDef, "log:"), "//")
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		index, err = openLogIndex(path)
+	case strings.HasPrefix(connDef, "sqlite:"):
+		path := strings.TrimPrefix(strings.TrimPrefix(connDef, "sqlite:"), "//")
+		if path == "" {
+			path = sqliteFileName
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		index, err = openSqliteIndex(path, instance)
+	default:
+		index, err = openPostgresIndex(connDef, instance)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
@@ -4,43 +4,88 @@ import (
 	"context"
 	"io/fs"
 	"os"
+	"path/filepath"
 	"storj.io/storj/storagenode/blobstore"
 	"storj.io/storj/storagenode/blobstore/filestore"
 	"time"
 )
 
+// BlobInfo describes a stored piece and its physical location: the piece is the byte range
+// [Offset, Offset+Size) of the (shared) file.
 type BlobInfo struct {
-	ref     blobstore.BlobRef
-	size    int64
-	created time.Time
+	dir   string
+	piece Piece
+}
+
+func newBlobInfo(dir string, piece Piece) BlobInfo {
+	return BlobInfo{
+		dir:   dir,
+		piece: piece,
+	}
 }
 
 func (i BlobInfo) BlobRef() blobstore.BlobRef {
-	return i.ref
+	return i.piece.Ref
 }
 
 func (i BlobInfo) StorageFormatVersion() blobstore.FormatVersion {
 	return filestore.FormatV1
 }
 
+// File returns the path of the file holding the data, relative to the store directory.
+func (i BlobInfo) File() string {
+	return i.piece.Slot.File
+}
+
+// Offset returns the position of the data in the file.
+func (i BlobInfo) Offset() int64 {
+	return i.piece.Slot.Start
+}
+
+// Size returns the size of the piece.
+func (i BlobInfo) Size() int64 {
+	return i.piece.Size
+}
+
+// Created returns the commit time of the piece.
+func (i BlobInfo) Created() time.Time {
+	return i.piece.Created
+}
+
+// Accessed returns the last (recorded) access time of the piece.
+func (i BlobInfo) Accessed() time.Time {
+	return i.piece.Accessed
+}
+
+// Trashed returns true and the time of trashing if the piece is in the trash.
+func (i BlobInfo) Trashed() (bool, time.Time) {
+	return i.piece.Trash, i.piece.TrashedAt
+}
+
+// Piece returns the index entry of the piece.
+func (i BlobInfo) Piece() Piece {
+	return i.piece
+}
+
+// FullPath returns the path of the file holding the data. The file may be shared with other pieces,
+// the data of this one starts at Offset.
 func (i BlobInfo) FullPath(ctx context.Context) (string, error) {
-	return "", nil
+	return filepath.Join(i.dir, i.piece.Slot.File), nil
 }
 
 func (i BlobInfo) Stat(ctx context.Context) (os.FileInfo, error) {
 	return FileInfo{
-		name:    "...",
-		size:    i.size,
-		created: i.created,
+		name:  filepath.Base(RefToFile(i.piece.Ref)),
+		piece: i.piece,
 	}, nil
 }
 
 var _ blobstore.BlobInfo = BlobInfo{}
 
+// FileInfo presents a piece as a read-only regular file, named as the blob file of the filestore.
 type FileInfo struct {
-	name    string
-	size    int64
-	created time.Time
+	name  string
+	piece Piece
 }
 
 func (f FileInfo) Name() string {
@@ -48,24 +93,24 @@ func (f FileInfo) Name() string {
 }
 
 func (f FileInfo) Size() int64 {
-	return f.size
+	return f.piece.Size
 }
 
 func (f FileInfo) Mode() fs.FileMode {
-	//TODO implement me
-	panic("implement me")
+	return 0444
 }
 
 func (f FileInfo) ModTime() time.Time {
-	return f.created
+	return f.piece.Created
 }
 
 func (f FileInfo) IsDir() bool {
 	return false
 }
 
+// Sys returns the Piece.
 func (f FileInfo) Sys() any {
-	return ""
+	return f.piece
 }
 
 var _ os.FileInfo = &FileInfo{}
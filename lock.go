@@ -0,0 +1,34 @@
+package largefile
+
+import (
+	"github.com/pkg/errors"
+	"github.com/zeebo/errs"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+)
+
+// lockFileName is the file of the store dir which is locked while a store is open.
+const lockFileName = "largefile.lock"
+
+// lockDir takes an exclusive lock on the store dir, so a second process (e.g. stlf fsck beside the
+// running node) can't open the same store. The lock is released when the returned file is closed.
+func lockDir(dir string) (*os.File, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err != nil {
+		_ = f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, errs.New("store directory %s is used by another process", dir)
+		}
+		return nil, errors.WithStack(err)
+	}
+	return f, nil
+}
@@ -0,0 +1,325 @@
+package largefile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/zeebo/errs"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	logIndexFileName      = "index.log"
+	snapshotIndexFileName = "index.snapshot"
+
+	// snapshotEvery is the number of log records after which a new snapshot is written.
+	snapshotEvery = 10000
+
+	maxLogRecordSize = 64 << 20
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// logIndex is a memIndex persisted in the store directory. Every modification is appended to a
+// log file which is replaced by a snapshot of the full state from time to time.
+//
+// A log record is [length uint32][crc32c uint32][json payload]. Records after the first torn or
+// corrupt one (crash during append) are dropped on open.
+//
+// The snapshot is encoded and written in the background: the state is copied under the lock, and
+// the log is replaced by its records after the copy when the snapshot is saved.
+type logIndex struct {
+	*memIndex
+	dir     string
+	log     *os.File
+	size    int64
+	seq     int64
+	records int
+	// syncMode none skips the fsync of the appended records.
+	syncMode SyncMode
+
+	snapshots    sync.WaitGroup
+	snapshotting bool
+	// snapshotErr is the error of the last background snapshot, returned by the next append.
+	snapshotErr error
+}
+
+// logRecord is one atomic batch of modifications.
+type logRecord struct {
+	Seq int64     `json:"seq"`
+	Ops []indexOp `json:"ops"`
+}
+
+// logSnapshot is the full state of the index, including all the records up to Seq.
+type logSnapshot struct {
+	Seq    int64         `json:"seq"`
+	LastID int64         `json:"lastID"`
+	Slots  []Slot        `json:"slots"`
+	Pieces []storedPiece `json:"pieces"`
+	Meta   []metaEntry   `json:"meta,omitempty"`
+}
+
+var _ Index = &logIndex{}
+
+func openLogIndex(dir string) (*logIndex, error) {
+	l := &logIndex{
+		memIndex: newMemIndex(),
+		dir:      dir,
+		syncMode: SyncCommit,
+	}
+	err := l.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	l.log, err = os.OpenFile(filepath.Join(dir, logIndexFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = l.replay()
+	if err != nil {
+		_ = l.log.Close()
+		return nil, err
+	}
+	l.memIndex.journal = l.append
+	return l, nil
+}
+
+func (l *logIndex) loadSnapshot() error {
+	raw, err := os.ReadFile(filepath.Join(l.dir, snapshotIndexFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var snapshot logSnapshot
+	err = json.Unmarshal(raw, &snapshot)
+	if err != nil {
+		return errs.New("corrupted index snapshot: %v", err)
+	}
+	l.seq = snapshot.Seq
+	l.lastID = snapshot.LastID
+	for i := range snapshot.Slots {
+		l.apply(indexOp{PutSlot: &snapshot.Slots[i]})
+	}
+	for i := range snapshot.Pieces {
+		l.apply(indexOp{PutPiece: &snapshot.Pieces[i]})
+	}
+	for i := range snapshot.Meta {
+		l.apply(indexOp{PutMeta: &snapshot.Meta[i]})
+	}
+	return nil
+}
+
+// replay applies the valid records of the log and truncates the torn tail, if any.
+func (l *logIndex) replay() error {
+	reader := bufio.NewReader(l.log)
+	var valid int64
+	header := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			break
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > maxLogRecordSize {
+			break
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			break
+		}
+		if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(header[4:8]) {
+			break
+		}
+		var record logRecord
+		if err := json.Unmarshal(payload, &record); err != nil {
+			break
+		}
+		valid += int64(len(header) + len(payload))
+		l.records++
+		if record.Seq <= l.seq {
+			// already part of the snapshot
+			continue
+		}
+		l.seq = record.Seq
+		for _, op := range record.Ops {
+			l.apply(op)
+		}
+	}
+
+	l.size = valid
+	return errors.WithStack(l.log.Truncate(valid))
+}
+
+// setSyncMode changes when the appended records are flushed.
+func (l *logIndex) setSyncMode(mode SyncMode) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.syncMode = mode
+}
+
+// append writes the ops as one record to the log. It's called by memIndex with the lock held.
+// Records which are not durable are flushed by the next durable one.
+func (l *logIndex) append(ops []indexOp, durable bool) error {
+	if err := l.snapshotErr; err != nil {
+		l.snapshotErr = nil
+		return err
+	}
+	if l.records >= snapshotEvery && !l.snapshotting {
+		state, offset, records := l.capture()
+		l.snapshotting = true
+		l.snapshots.Add(1)
+		go func() {
+			defer l.snapshots.Done()
+			err := l.writeSnapshot(state, offset, records)
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.snapshotting = false
+			l.snapshotErr = err
+		}()
+	}
+
+	payload, err := json.Marshal(logRecord{
+		Seq: l.seq + 1,
+		Ops: ops,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	frame := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, castagnoli))
+	copy(frame[8:], payload)
+
+	_, err = l.log.WriteAt(frame, l.size)
+	if err != nil {
+		// don't leave a partial record behind the next one
+		_ = l.log.Truncate(l.size)
+		return errors.WithStack(err)
+	}
+	if durable && l.syncMode != SyncNone {
+		err = l.log.Sync()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	l.size += int64(len(frame))
+	l.seq++
+	l.records++
+	return nil
+}
+
+// snapshot saves the current state and empties the log.
+func (l *logIndex) snapshot() error {
+	l.mu.Lock()
+	state, offset, records := l.capture()
+	l.mu.Unlock()
+	return l.writeSnapshot(state, offset, records)
+}
+
+// capture copies the current state, with the size of the log and the number of records it
+// includes. Must be called with the lock held.
+func (l *logIndex) capture() (state logSnapshot, offset int64, records int) {
+	state = logSnapshot{
+		Seq:    l.seq,
+		LastID: l.lastID,
+		Slots:  make([]Slot, 0, len(l.slots)),
+		Pieces: make([]storedPiece, 0, len(l.pieces)),
+	}
+	for _, slot := range l.slots {
+		state.Slots = append(state.Slots, slot)
+	}
+	for k, p := range l.pieces {
+		state.Pieces = append(state.Pieces, *putPiece(k, *p).PutPiece)
+	}
+	for name, value := range l.meta {
+		state.Meta = append(state.Meta, metaEntry{Name: name, Value: value})
+	}
+	return state, l.size, l.records
+}
+
+// writeSnapshot saves the captured state, and replaces the log with the records appended after the
+// capture (offset). The records before the offset would be skipped based on seq anyway.
+func (l *logIndex) writeSnapshot(state logSnapshot, offset int64, records int) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := filepath.Join(l.dir, snapshotIndexFileName+".tmp")
+	err = writeFileSync(tmp, raw)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, filepath.Join(l.dir, snapshotIndexFileName))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = syncDir(l.dir)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tail := make([]byte, l.size-offset)
+	_, err = l.log.ReadAt(tail, offset)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp = filepath.Join(l.dir, logIndexFileName+".tmp")
+	log, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = log.Write(tail)
+	if err == nil {
+		err = log.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(l.dir, logIndexFileName))
+	}
+	if err != nil {
+		return errs.Combine(errors.WithStack(err), log.Close())
+	}
+	// the new log is in place, it's used even if the directory sync fails
+	_ = l.log.Close()
+	l.log = log
+	l.size = int64(len(tail))
+	l.records -= records
+	return syncDir(l.dir)
+}
+
+func (l *logIndex) Close() error {
+	l.snapshots.Wait()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return errors.WithStack(errs.Combine(l.log.Sync(), l.log.Close()))
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	return errs.Combine(errors.WithStack(err), f.Close())
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errs.Combine(errors.WithStack(d.Sync()), d.Close())
+}
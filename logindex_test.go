@@ -0,0 +1,101 @@
+package largefile
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"storj.io/storj/storagenode/blobstore"
+	"testing"
+	"time"
+)
+
+func TestLogIndexReopen(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	index, err := openLogIndex(dir)
+	require.NoError(t, err)
+
+	ref := func(i int) blobstore.BlobRef {
+		return blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte{byte(i)}}
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, index.Insert(ctx, ref(i), Slot{File: "segment", Start: int64(i * 10), Size: 10}))
+	}
+	require.NoError(t, index.Trash(ctx, ref(1)))
+	_, err = index.Delete(ctx, ref(2))
+	require.NoError(t, err)
+	require.NoError(t, index.snapshot())
+	_, err = index.Delete(ctx, ref(3))
+	require.NoError(t, err)
+	require.NoError(t, index.Close())
+
+	// simulate a crash during the next append
+	log, err := os.OpenFile(filepath.Join(dir, logIndexFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = log.Write([]byte{0, 0, 0, 100, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	index, err = openLogIndex(dir)
+	require.NoError(t, err)
+
+	used, err := index.SpaceUsedForBlobs(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(70), used)
+
+	_, err = index.Get(ctx, ref(1))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = index.Get(ctx, ref(3))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	piece, err := index.Get(ctx, ref(9))
+	require.NoError(t, err)
+	require.Equal(t, int64(90), piece.Slot.Start)
+
+	// the torn record is dropped, new records are appended after the last valid one
+	require.NoError(t, index.Insert(ctx, ref(10), Slot{File: "segment", Start: 100, Size: 10}))
+	require.NoError(t, index.Close())
+	index, err = openLogIndex(dir)
+	require.NoError(t, err)
+	_, err = index.Get(ctx, ref(10))
+	require.NoError(t, err)
+	require.NoError(t, index.Close())
+}
+
+func TestLogIndexBackgroundSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	index, err := openLogIndex(dir)
+	require.NoError(t, err)
+	index.setSyncMode(SyncNone)
+
+	ref := func(i int) blobstore.BlobRef {
+		return blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte(fmt.Sprintf("piece%d", i))}
+	}
+	count := snapshotEvery + 100
+	for i := 0; i < count; i++ {
+		require.NoError(t, index.Insert(ctx, ref(i), Slot{File: "segment", Start: int64(i * 10), Size: 10}))
+	}
+	require.NoError(t, index.Touch(ctx, []Access{{Ref: ref(0), Time: time.Now()}}))
+	index.snapshots.Wait()
+
+	// the log contains only the records after the snapshot
+	index.mu.Lock()
+	records := index.records
+	index.mu.Unlock()
+	require.Less(t, records, 200)
+	_, err = os.Stat(filepath.Join(dir, snapshotIndexFileName))
+	require.NoError(t, err)
+	require.NoError(t, index.Close())
+
+	index, err = openLogIndex(dir)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, index.Close()) }()
+	used, err := index.SpaceUsedForBlobs(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(count*10), used)
+}
@@ -0,0 +1,680 @@
+package largefile
+
+import (
+	"context"
+	"github.com/zeebo/errs"
+	"os"
+	"sort"
+	"storj.io/storj/storagenode/blobstore"
+	"sync"
+	"time"
+)
+
+// memIndex keeps the metadata in memory only. It behaves the same way as the sql index.
+// All the modifications are expressed as indexOp batches, which can be persisted by a journal.
+type memIndex struct {
+	mu     sync.Mutex
+	pieces map[pieceKey]*memPiece
+	slots  map[int64]Slot
+	meta   map[string]string
+	lastID int64
+	// fileSlots are the slot ids of the files, slotPieces is the number of pieces of the slots.
+	fileSlots  map[string]map[int64]bool
+	slotPieces map[int64]int
+	// journal persists the ops, durable is false if the ops may be lost by a crash (access times).
+	journal func(ops []indexOp, durable bool) error
+}
+
+type pieceKey struct {
+	namespace string
+	key       string
+}
+
+type memPiece struct {
+	size      int64
+	trash     bool
+	trashedAt time.Time
+	slotID    int64
+	created   time.Time
+	accessed  time.Time
+}
+
+// indexOp is one modification of the memIndex. Exactly one of the fields is set.
+type indexOp struct {
+	PutSlot     *Slot        `json:"ps,omitempty"`
+	DeleteSlot  int64        `json:"ds,omitempty"`
+	PutPiece    *storedPiece `json:"pp,omitempty"`
+	DeletePiece *storedPiece `json:"dp,omitempty"`
+	PutMeta     *metaEntry   `json:"pm,omitempty"`
+}
+
+// metaEntry is a value of the store level metadata.
+type metaEntry struct {
+	Name  string `json:"n"`
+	Value string `json:"v"`
+}
+
+// storedPiece is the serialized form of a memPiece.
+type storedPiece struct {
+	Namespace []byte    `json:"n"`
+	Key       []byte    `json:"k"`
+	Size      int64     `json:"s,omitempty"`
+	Trash     bool      `json:"t,omitempty"`
+	TrashedAt time.Time `json:"ta,omitempty"`
+	SlotID    int64     `json:"i,omitempty"`
+	Created   time.Time `json:"c,omitempty"`
+	Accessed  time.Time `json:"a,omitempty"`
+}
+
+var _ Index = &memIndex{}
+
+func newMemIndex() *memIndex {
+	return &memIndex{
+		pieces: map[pieceKey]*memPiece{},
+		slots:  map[int64]Slot{},
+		meta:   map[string]string{},
+
+		fileSlots:  map[string]map[int64]bool{},
+		slotPieces: map[int64]int{},
+	}
+}
+
+func keyOf(ref blobstore.BlobRef) pieceKey {
+	return pieceKey{
+		namespace: string(ref.Namespace),
+		key:       string(ref.Key),
+	}
+}
+
+func (k pieceKey) ref() blobstore.BlobRef {
+	return blobstore.BlobRef{
+		Namespace: []byte(k.namespace),
+		Key:       []byte(k.key),
+	}
+}
+
+func (m *memIndex) piece(k pieceKey, p *memPiece) Piece {
+	return Piece{
+		Ref:       k.ref(),
+		Size:      p.size,
+		Trash:     p.trash,
+		TrashedAt: p.trashedAt,
+		Created:   p.created,
+		Accessed:  p.accessed,
+		Slot:      m.slots[p.slotID],
+	}
+}
+
+// SchemaStatus reports the latest version as the in-memory structures are always up-to-date.
+func (m *memIndex) SchemaStatus(ctx context.Context) (SchemaStatus, error) {
+	return SchemaStatus{
+		Current: LatestSchemaVersion,
+		Latest:  LatestSchemaVersion,
+	}, nil
+}
+
+func (m *memIndex) Migrate(ctx context.Context) error {
+	return nil
+}
+
+func putPiece(k pieceKey, p memPiece) indexOp {
+	return indexOp{
+		PutPiece: &storedPiece{
+			Namespace: []byte(k.namespace),
+			Key:       []byte(k.key),
+			Size:      p.size,
+			Trash:     p.trash,
+			TrashedAt: p.trashedAt,
+			SlotID:    p.slotID,
+			Created:   p.created,
+			Accessed:  p.accessed,
+		},
+	}
+}
+
+func deletePiece(k pieceKey) indexOp {
+	return indexOp{
+		DeletePiece: &storedPiece{
+			Namespace: []byte(k.namespace),
+			Key:       []byte(k.key),
+		},
+	}
+}
+
+// commit persists the ops with the journal (if any) and applies them. Must be called with the lock held.
+func (m *memIndex) commit(ops ...indexOp) error {
+	return m.commitOps(ops, true)
+}
+
+// commitOps is commit, without waiting for the ops to be durable if durable is false.
+func (m *memIndex) commitOps(ops []indexOp, durable bool) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	if m.journal != nil {
+		if err := m.journal(ops, durable); err != nil {
+			return err
+		}
+	}
+	for _, op := range ops {
+		m.apply(op)
+	}
+	return nil
+}
+
+func (m *memIndex) apply(op indexOp) {
+	switch {
+	case op.PutSlot != nil:
+		m.unlinkSlot(op.PutSlot.ID)
+		m.slots[op.PutSlot.ID] = *op.PutSlot
+		if m.fileSlots[op.PutSlot.File] == nil {
+			m.fileSlots[op.PutSlot.File] = map[int64]bool{}
+		}
+		m.fileSlots[op.PutSlot.File][op.PutSlot.ID] = true
+		if op.PutSlot.ID > m.lastID {
+			m.lastID = op.PutSlot.ID
+		}
+	case op.DeleteSlot != 0:
+		m.unlinkSlot(op.DeleteSlot)
+		delete(m.slots, op.DeleteSlot)
+	case op.PutPiece != nil:
+		p := &memPiece{
+			size:      op.PutPiece.Size,
+			trash:     op.PutPiece.Trash,
+			trashedAt: op.PutPiece.TrashedAt,
+			slotID:    op.PutPiece.SlotID,
+			created:   op.PutPiece.Created,
+			accessed:  op.PutPiece.Accessed,
+		}
+		if p.trash && p.trashedAt.IsZero() {
+			// trashed by an older version, without time
+			p.trashedAt = time.Now()
+		}
+		k := pieceKey{namespace: string(op.PutPiece.Namespace), key: string(op.PutPiece.Key)}
+		m.unlinkPiece(k)
+		m.pieces[k] = p
+		m.slotPieces[p.slotID]++
+	case op.DeletePiece != nil:
+		k := pieceKey{namespace: string(op.DeletePiece.Namespace), key: string(op.DeletePiece.Key)}
+		m.unlinkPiece(k)
+		delete(m.pieces, k)
+	case op.PutMeta != nil:
+		m.meta[op.PutMeta.Name] = op.PutMeta.Value
+	}
+}
+
+// unlinkSlot removes the slot from the slots of its file.
+func (m *memIndex) unlinkSlot(id int64) {
+	slot, found := m.slots[id]
+	if !found {
+		return
+	}
+	delete(m.fileSlots[slot.File], id)
+	if len(m.fileSlots[slot.File]) == 0 {
+		delete(m.fileSlots, slot.File)
+	}
+}
+
+// unlinkPiece removes the piece from the pieces of its slot.
+func (m *memIndex) unlinkPiece(k pieceKey) {
+	p, found := m.pieces[k]
+	if !found {
+		return
+	}
+	m.slotPieces[p.slotID]--
+	if m.slotPieces[p.slotID] <= 0 {
+		delete(m.slotPieces, p.slotID)
+	}
+}
+
+func (m *memIndex) Insert(ctx context.Context, ref blobstore.BlobRef, slot Slot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := keyOf(ref)
+	if _, found := m.pieces[k]; found {
+		return errs.New("piece already exists")
+	}
+	now := time.Now()
+	slot.ID = m.lastID + 1
+	return m.commit(indexOp{PutSlot: &slot}, putPiece(k, memPiece{
+		size:     slot.Size,
+		slotID:   slot.ID,
+		created:  now,
+		accessed: now,
+	}))
+}
+
+func (m *memIndex) GetMeta(ctx context.Context, name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, found := m.meta[name]
+	if !found {
+		return "", os.ErrNotExist
+	}
+	return value, nil
+}
+
+func (m *memIndex) SetMetas(ctx context.Context, values map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ops []indexOp
+	for name, value := range values {
+		ops = append(ops, indexOp{PutMeta: &metaEntry{Name: name, Value: value}})
+	}
+	return m.commit(ops...)
+}
+
+func (m *memIndex) Get(ctx context.Context, ref blobstore.BlobRef) (Piece, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := keyOf(ref)
+	p, found := m.pieces[k]
+	if !found || p.trash {
+		return Piece{Ref: ref}, os.ErrNotExist
+	}
+	if _, found := m.slots[p.slotID]; !found {
+		return Piece{Ref: ref}, os.ErrNotExist
+	}
+	return m.piece(k, p), nil
+}
+
+func (m *memIndex) Touch(ctx context.Context, accesses []Access) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ops []indexOp
+	for _, access := range accesses {
+		k := keyOf(access.Ref)
+		p, found := m.pieces[k]
+		if !found {
+			continue
+		}
+		touched := *p
+		touched.accessed = access.Time
+		ops = append(ops, putPiece(k, touched))
+	}
+	// losing access times in a crash is acceptable
+	return m.commitOps(ops, false)
+}
+
+func (m *memIndex) Delete(ctx context.Context, ref blobstore.BlobRef) ([]Piece, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := keyOf(ref)
+	p, found := m.pieces[k]
+	if !found {
+		return nil, nil
+	}
+	piece := m.piece(k, p)
+	if err := m.commit(m.deleteOps(k, p)...); err != nil {
+		return nil, err
+	}
+	return []Piece{piece}, nil
+}
+
+func (m *memIndex) DeleteNamespace(ctx context.Context, namespace []byte, limit int) ([]Piece, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deletePieces(func(k pieceKey, p *memPiece) bool {
+		return k.namespace == string(namespace)
+	}, limit)
+}
+
+// deletePieces deletes at most limit matching pieces with their slots. Must be called with the lock held.
+func (m *memIndex) deletePieces(match func(k pieceKey, p *memPiece) bool, limit int) ([]Piece, error) {
+	var pieces []Piece
+	var ops []indexOp
+	for k, p := range m.pieces {
+		if limit > 0 && len(pieces) >= limit {
+			break
+		}
+		if !match(k, p) {
+			continue
+		}
+		pieces = append(pieces, m.piece(k, p))
+		ops = append(ops, m.deleteOps(k, p)...)
+	}
+	if err := m.commit(ops...); err != nil {
+		return nil, err
+	}
+	return pieces, nil
+}
+
+// deleteOps returns the operations deleting the piece and its slot. Must be called with the lock held.
+func (m *memIndex) deleteOps(k pieceKey, p *memPiece) []indexOp {
+	ops := []indexOp{deletePiece(k)}
+	if _, found := m.slots[p.slotID]; found {
+		ops = append(ops, indexOp{DeleteSlot: p.slotID})
+	}
+	return ops
+}
+
+func (m *memIndex) Trash(ctx context.Context, ref blobstore.BlobRef) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := keyOf(ref)
+	p, found := m.pieces[k]
+	if !found || p.trash {
+		return nil
+	}
+	trashed := *p
+	trashed.trash = true
+	trashed.trashedAt = time.Now()
+	return m.commit(putPiece(k, trashed))
+}
+
+func (m *memIndex) RestoreTrash(ctx context.Context, namespace []byte) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([][]byte, 0)
+	var ops []indexOp
+	for k, p := range m.pieces {
+		if k.namespace == string(namespace) && p.trash {
+			restored := *p
+			restored.trash = false
+			restored.trashedAt = time.Time{}
+			ops = append(ops, putPiece(k, restored))
+			keys = append(keys, []byte(k.key))
+		}
+	}
+	if err := m.commit(ops...); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (m *memIndex) EmptyTrash(ctx context.Context, namespace []byte, trashedBefore time.Time) ([]Piece, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deletePieces(func(k pieceKey, p *memPiece) bool {
+		return k.namespace == string(namespace) && p.trash && p.trashedAt.Before(trashedBefore)
+	}, 0)
+}
+
+func (m *memIndex) SpaceUsedForTrash(ctx context.Context) (res int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.pieces {
+		if p.trash {
+			res += p.size
+		}
+	}
+	return res, nil
+}
+
+func (m *memIndex) SpaceUsedForTrashInNamespace(ctx context.Context, namespace []byte) (res int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, p := range m.pieces {
+		if p.trash && k.namespace == string(namespace) {
+			res += p.size
+		}
+	}
+	return res, nil
+}
+
+func (m *memIndex) SpaceUsedForBlobs(ctx context.Context) (res int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.pieces {
+		if !p.trash {
+			res += p.size
+		}
+	}
+	return res, nil
+}
+
+func (m *memIndex) SpaceUsedForBlobsInNamespace(ctx context.Context, namespace []byte) (res int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, p := range m.pieces {
+		if !p.trash && k.namespace == string(namespace) {
+			res += p.size
+		}
+	}
+	return res, nil
+}
+
+func (m *memIndex) ListNamespaces(ctx context.Context) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := map[string]bool{}
+	res := make([][]byte, 0)
+	for k := range m.pieces {
+		if !seen[k.namespace] {
+			seen[k.namespace] = true
+			res = append(res, []byte(k.namespace))
+		}
+	}
+	return res, nil
+}
+
+// collect returns a snapshot of the matching pieces, so callbacks can run without holding the lock.
+func (m *memIndex) collect(match func(k pieceKey, p *memPiece) bool) []Piece {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []Piece
+	for k, p := range m.pieces {
+		if match(k, p) {
+			res = append(res, m.piece(k, p))
+		}
+	}
+	return res
+}
+
+func (m *memIndex) WalkNamespace(ctx context.Context, namespace []byte, fn func(Piece) error) error {
+	pieces := m.collect(func(k pieceKey, p *memPiece) bool {
+		return !p.trash && k.namespace == string(namespace)
+	})
+	for _, p := range pieces {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memIndex) WalkPieces(ctx context.Context, fn func(Piece) error) error {
+	pieces := m.collect(func(k pieceKey, p *memPiece) bool {
+		_, found := m.slots[p.slotID]
+		return !p.trash && found
+	})
+	for _, p := range pieces {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memIndex) MoveSlot(ctx context.Context, ref blobstore.BlobRef, slot Slot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	slot.ID = m.lastID + 1
+	ops := []indexOp{{PutSlot: &slot}}
+	k := keyOf(ref)
+	if p, found := m.pieces[k]; found {
+		moved := *p
+		moved.slotID = slot.ID
+		ops = append(ops, putPiece(k, moved))
+	}
+	return m.commit(ops...)
+}
+
+func (m *memIndex) UnusedFiles(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	used := map[string]bool{}
+	for _, slot := range m.slots {
+		if _, found := used[slot.File]; !found {
+			used[slot.File] = false
+		}
+	}
+	for _, p := range m.pieces {
+		if slot, found := m.slots[p.slotID]; found && !p.trash {
+			used[slot.File] = true
+		}
+	}
+	var files []string
+	for file, inUse := range used {
+		if !inUse {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+func (m *memIndex) DeleteSlots(ctx context.Context, file string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ops []indexOp
+	for id, slot := range m.slots {
+		if slot.File == file {
+			ops = append(ops, indexOp{DeleteSlot: id})
+		}
+	}
+	return m.commit(ops...)
+}
+
+func (m *memIndex) FileUsage(ctx context.Context) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage := map[string]int64{}
+	for _, slot := range m.slots {
+		usage[slot.File] += 0
+	}
+	for _, p := range m.pieces {
+		if slot, found := m.slots[p.slotID]; found {
+			usage[slot.File] += slot.Size
+		}
+	}
+	return usage, nil
+}
+
+func (m *memIndex) FileInUse(ctx context.Context, file string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id := range m.fileSlots[file] {
+		if m.slotPieces[id] > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memIndex) WalkFile(ctx context.Context, file string, fn func(Piece) error) error {
+	pieces := m.collect(func(k pieceKey, p *memPiece) bool {
+		slot, found := m.slots[p.slotID]
+		return found && slot.File == file
+	})
+	sort.Slice(pieces, func(i, j int) bool {
+		return pieces[i].Slot.Start < pieces[j].Slot.Start
+	})
+	for _, p := range pieces {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memIndex) ListSlots(ctx context.Context, after Slot, limit int) ([]Piece, error) {
+	pieces := m.collect(func(k pieceKey, p *memPiece) bool {
+		slot, found := m.slots[p.slotID]
+		return found && !p.trash && slotBefore(after, slot)
+	})
+	sort.Slice(pieces, func(i, j int) bool {
+		return slotBefore(pieces[i].Slot, pieces[j].Slot)
+	})
+	if len(pieces) > limit {
+		pieces = pieces[:limit]
+	}
+	return pieces, nil
+}
+
+func (m *memIndex) WalkSlots(ctx context.Context, fn func(slot Slot, piece *Piece) error) error {
+	type entry struct {
+		slot  Slot
+		piece *Piece
+	}
+	m.mu.Lock()
+	used := map[int64]*Piece{}
+	for k, p := range m.pieces {
+		piece := m.piece(k, p)
+		used[p.slotID] = &piece
+	}
+	var entries []entry
+	for id, slot := range m.slots {
+		entries = append(entries, entry{slot: slot, piece: used[id]})
+	}
+	m.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return slotBefore(entries[i].slot, entries[j].slot)
+	})
+	for _, e := range entries {
+		if err := fn(e.slot, e.piece); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// slotBefore orders the slots by file, start and id.
+func slotBefore(a, b Slot) bool {
+	if a.File != b.File {
+		return a.File < b.File
+	}
+	if a.Start != b.Start {
+		return a.Start < b.Start
+	}
+	return a.ID < b.ID
+}
+
+func (m *memIndex) DeleteUnusedSlots(ctx context.Context, ids []int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	used := map[int64]bool{}
+	for _, p := range m.pieces {
+		used[p.slotID] = true
+	}
+	var ops []indexOp
+	for _, id := range ids {
+		if _, found := m.slots[id]; found && !used[id] {
+			ops = append(ops, indexOp{DeleteSlot: id})
+		}
+	}
+	if err := m.commit(ops...); err != nil {
+		return 0, err
+	}
+	return len(ops), nil
+}
+
+func (m *memIndex) Relocate(ctx context.Context, moves []Relocation) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ops []indexOp
+	applied := 0
+	id := m.lastID
+	for _, move := range moves {
+		k := keyOf(move.Ref)
+		p, found := m.pieces[k]
+		if found && p.slotID == move.From {
+			id++
+			slot := move.To
+			slot.ID = id
+			moved := *p
+			moved.slotID = id
+			ops = append(ops, indexOp{PutSlot: &slot}, putPiece(k, moved), indexOp{DeleteSlot: move.From})
+			applied++
+		}
+		// otherwise the piece is deleted or moved in the meantime, the new slot is not created
+	}
+	if err := m.commit(ops...); err != nil {
+		return 0, err
+	}
+	return applied, nil
+}
+
+func (m *memIndex) Close() error {
+	return nil
+}
@@ -0,0 +1,270 @@
+package largefile
+
+import (
+	"context"
+	"database/sql"
+	"github.com/pkg/errors"
+	"github.com/zeebo/errs"
+)
+
+// SchemaStatus describes the state of the metadata schema.
+type SchemaStatus struct {
+	Current int
+	Latest  int
+	// Pending contains the description of the steps which are not applied yet.
+	Pending []string
+}
+
+// migration is one step of the sql schema. The missing steps are applied in order, in one
+// transaction.
+type migration struct {
+	Version     int
+	Description string
+	Postgres    []string
+	Sqlite      []string
+}
+
+var migrations = []migration{
+	{
+		Version:     1,
+		Description: "create pieces and slots tables",
+		Postgres: []string{
+			"create table if not exists pieces (namespace BYTEA not null, key BYTEA not null, size int NOT NULL DEFAULT 0,trash bool not null default false,slot_id int not null,created timestamp not null default current_timestamp,accessed timestamp not null default current_timestamp,PRIMARY KEY(namespace, key))",
+			"create table if not exists slots (id serial primary key, file text NOT NULL, start int NOT NULL DEFAULT 0, size int NOT NULL DEFAULT 0)",
+		},
+		Sqlite: []string{
+			"create table if not exists pieces (namespace BLOB not null, key BLOB not null, size int NOT NULL DEFAULT 0,trash bool not null default false,slot_id int not null,created timestamp not null default current_timestamp,accessed timestamp not null default current_timestamp,PRIMARY KEY(namespace, key))",
+			"create table if not exists slots (id integer primary key autoincrement, file text NOT NULL, start int NOT NULL DEFAULT 0, size int NOT NULL DEFAULT 0)",
+		},
+	},
+	{
+		Version:     2,
+		Description: "add checksum to slots",
+		Postgres: []string{
+			"alter table slots add column checksum bigint",
+		},
+		Sqlite: []string{
+			"alter table slots add column checksum bigint",
+		},
+	},
+	{
+		Version:     3,
+		Description: "add trashed_at to pieces",
+		Postgres: []string{
+			"alter table pieces add column trashed_at timestamp",
+			"update pieces set trashed_at = timezone('utc', now()) where trash",
+		},
+		Sqlite: []string{
+			"alter table pieces add column trashed_at timestamp",
+			"update pieces set trashed_at = current_timestamp where trash",
+		},
+	},
+	{
+		Version:     4,
+		Description: "create largefile_meta table",
+		Postgres: []string{
+			"create table largefile_meta (name text primary key, value text not null)",
+		},
+		Sqlite: []string{
+			"create table largefile_meta (name text primary key, value text not null)",
+		},
+	},
+	{
+		Version:     5,
+		Description: "add instance to pieces, slots and largefile_meta",
+		Postgres: []string{
+			"alter table pieces add column instance text not null default ''",
+			"alter table pieces drop constraint pieces_pkey",
+			"alter table pieces add primary key (instance, namespace, key)",
+			"alter table slots add column instance text not null default ''",
+			"create index slots_instance_file on slots (instance, file, start)",
+			"alter table largefile_meta add column instance text not null default ''",
+			"alter table largefile_meta drop constraint largefile_meta_pkey",
+			"alter table largefile_meta add primary key (instance, name)",
+		},
+		// the primary key can't be changed in sqlite, the tables are rebuilt
+		Sqlite: []string{
+			"create table pieces_new (instance text not null default '', namespace BLOB not null, key BLOB not null, size int NOT NULL DEFAULT 0, trash bool not null default false, slot_id int not null, created timestamp not null default current_timestamp, accessed timestamp not null default current_timestamp, trashed_at timestamp, PRIMARY KEY(instance, namespace, key))",
+			"insert into pieces_new (namespace, key, size, trash, slot_id, created, accessed, trashed_at) select namespace, key, size, trash, slot_id, created, accessed, trashed_at from pieces",
+			"drop table pieces",
+			"alter table pieces_new rename to pieces",
+			"alter table slots add column instance text not null default ''",
+			"create index slots_instance_file on slots (instance, file, start)",
+			"create table largefile_meta_new (instance text not null default '', name text not null, value text not null, PRIMARY KEY(instance, name))",
+			"insert into largefile_meta_new (name, value) select name, value from largefile_meta",
+			"drop table largefile_meta",
+			"alter table largefile_meta_new rename to largefile_meta",
+		},
+	},
+	{
+		Version:     6,
+		Description: "use bigint for the sizes and the offsets",
+		Postgres: []string{
+			"alter table slots alter column start type bigint, alter column size type bigint",
+			"alter table pieces alter column size type bigint",
+		},
+		// the integers are 64-bit in sqlite anyway
+		Sqlite: []string{},
+	},
+	{
+		Version:     7,
+		Description: "create index on the slots of the pieces",
+		Postgres: []string{
+			"create index pieces_instance_slot on pieces (instance, slot_id)",
+		},
+		Sqlite: []string{
+			"create index pieces_instance_slot on pieces (instance, slot_id)",
+		},
+	},
+}
+
+// LatestSchemaVersion is the schema version used by this code.
+var LatestSchemaVersion = migrations[len(migrations)-1].Version
+
+const versionTable = "largefile_versions"
+
+// migrationLockID is the Postgres advisory lock which serializes the migrations of the stores
+// sharing the database. SQLite transactions are exclusive anyway.
+const migrationLockID = 0x6c617267656669
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (s *sqlIndex) tableExists(ctx context.Context, db querier, table string) (exists bool, err error) {
+	query := "SELECT count(*) > 0 FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1"
+	if s.sqlite {
+		query = "SELECT count(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = $1"
+	}
+	err = db.QueryRowContext(ctx, s.q(query), table).Scan(&exists)
+	return exists, errors.WithStack(err)
+}
+
+// version returns the current schema version. Databases created before the versioning (by
+// InitTable) are recognized as version 1, partially created ones are refused.
+func (s *sqlIndex) version(ctx context.Context, db querier) (version int, versioned bool, err error) {
+	versioned, err = s.tableExists(ctx, db, versionTable)
+	if err != nil {
+		return 0, false, err
+	}
+	if versioned {
+		err = db.QueryRowContext(ctx, "SELECT coalesce(max(version), 0) FROM "+versionTable).Scan(&version)
+		return version, true, errors.WithStack(err)
+	}
+
+	pieces, err := s.tableExists(ctx, db, "pieces")
+	if err != nil {
+		return 0, false, err
+	}
+	slots, err := s.tableExists(ctx, db, "slots")
+	if err != nil {
+		return 0, false, err
+	}
+	switch {
+	case pieces && slots:
+		return 1, false, nil
+	case pieces || slots:
+		return 0, false, errs.New("half-initialized database: pieces table exists: %t, slots table exists: %t", pieces, slots)
+	default:
+		return 0, false, nil
+	}
+}
+
+func (s *sqlIndex) SchemaStatus(ctx context.Context) (SchemaStatus, error) {
+	return s.schemaStatus(ctx, s.db)
+}
+
+func (s *sqlIndex) schemaStatus(ctx context.Context, db querier) (SchemaStatus, error) {
+	status := SchemaStatus{
+		Latest: LatestSchemaVersion,
+	}
+	var err error
+	status.Current, _, err = s.version(ctx, db)
+	if err != nil {
+		return status, err
+	}
+	if status.Current > status.Latest {
+		return status, errs.New("database schema version %d is newer than the supported version %d", status.Current, status.Latest)
+	}
+	for _, m := range migrations {
+		if m.Version > status.Current {
+			status.Pending = append(status.Pending, m.Description)
+		}
+	}
+	return status, nil
+}
+
+// Migrate applies the missing steps in one transaction. The version is detected in the same
+// transaction, after taking the migration lock, so the stores sharing the database don't apply the
+// same steps concurrently.
+func (s *sqlIndex) Migrate(ctx context.Context) (err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			err = errs.Combine(err, tx.Rollback())
+		} else {
+			err = errors.WithStack(tx.Commit())
+		}
+	}()
+	if !s.sqlite {
+		_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", int64(migrationLockID))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	status, err := s.schemaStatus(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if len(status.Pending) == 0 {
+		return nil
+	}
+	_, versioned, err := s.version(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "create table if not exists "+versionTable+" (version int NOT NULL PRIMARY KEY, description text NOT NULL, applied timestamp NOT NULL DEFAULT current_timestamp)")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !versioned && status.Current > 0 {
+		// tables created by InitTable, without version
+		_, err = tx.ExecContext(ctx, s.q("INSERT INTO "+versionTable+" (version, description) VALUES ($1, $2)"), status.Current, "adopted existing tables")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	for _, m := range migrations {
+		if m.Version <= status.Current {
+			continue
+		}
+		err = s.applyMigration(ctx, tx, m)
+		if err != nil {
+			return errs.New("migration to version %d (%s) is failed: %v", m.Version, m.Description, err)
+		}
+	}
+	return nil
+}
+
+func (s *sqlIndex) applyMigration(ctx context.Context, tx *sql.Tx, m migration) error {
+	statements := m.Postgres
+	if s.sqlite {
+		statements = m.Sqlite
+	}
+	for _, statement := range statements {
+		_, err := tx.ExecContext(ctx, statement)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	_, err := tx.ExecContext(ctx, s.q("INSERT INTO "+versionTable+" (version, description) VALUES ($1, $2)"), m.Version, m.Description)
+	return errors.WithStack(err)
+}
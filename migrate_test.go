@@ -0,0 +1,166 @@
+package largefile
+
+import (
+	"context"
+	"database/sql"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"storj.io/common/testcontext"
+	"storj.io/private/dbutil/pgutil"
+	"storj.io/storj/storagenode/blobstore"
+	"sync"
+	"testing"
+)
+
+func TestMigrateSqlite(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("fresh", func(t *testing.T) {
+		index, err := openSqliteIndex(filepath.Join(t.TempDir(), sqliteFileName), "")
+		require.NoError(t, err)
+		defer index.Close()
+
+		status, err := index.SchemaStatus(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 0, status.Current)
+		require.Len(t, status.Pending, len(migrations))
+
+		require.NoError(t, index.Migrate(ctx))
+		status, err = index.SchemaStatus(ctx)
+		require.NoError(t, err)
+		require.Equal(t, LatestSchemaVersion, status.Current)
+		require.Empty(t, status.Pending)
+
+		// second run is a no-op
+		require.NoError(t, index.Migrate(ctx))
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		index, err := openSqliteIndex(filepath.Join(t.TempDir(), sqliteFileName), "")
+		require.NoError(t, err)
+		defer index.Close()
+
+		for _, statement := range migrations[0].Sqlite {
+			_, err = index.db.ExecContext(ctx, statement)
+			require.NoError(t, err)
+		}
+		_, err = index.db.ExecContext(ctx, "INSERT INTO slots (id, file, start, size) VALUES (1, 'a', 0, 10)")
+		require.NoError(t, err)
+		_, err = index.db.ExecContext(ctx, "INSERT INTO pieces (namespace, key, size, slot_id) VALUES (x'6e73', x'6b', 10, 1)")
+		require.NoError(t, err)
+		status, err := index.SchemaStatus(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, status.Current)
+
+		require.NoError(t, index.Migrate(ctx))
+		status, err = index.SchemaStatus(ctx)
+		require.NoError(t, err)
+		require.Equal(t, LatestSchemaVersion, status.Current)
+
+		// the existing rows belong to the default instance
+		piece, err := index.Get(ctx, blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("k")})
+		require.NoError(t, err)
+		require.Equal(t, Slot{ID: 1, File: "a", Size: 10}, piece.Slot)
+	})
+
+	t.Run("half-initialized", func(t *testing.T) {
+		index, err := openSqliteIndex(filepath.Join(t.TempDir(), sqliteFileName), "")
+		require.NoError(t, err)
+		defer index.Close()
+
+		_, err = index.db.ExecContext(ctx, migrations[0].Sqlite[0])
+		require.NoError(t, err)
+		_, err = index.SchemaStatus(ctx)
+		require.Error(t, err)
+		require.Error(t, index.Migrate(ctx))
+	})
+
+	t.Run("too-new", func(t *testing.T) {
+		dir := t.TempDir()
+		index, err := openSqliteIndex(filepath.Join(dir, sqliteFileName), "")
+		require.NoError(t, err)
+		require.NoError(t, index.Migrate(ctx))
+		_, err = index.db.ExecContext(ctx, "INSERT INTO "+versionTable+" (version, description) VALUES (?, 'future')", LatestSchemaVersion+1)
+		require.NoError(t, err)
+		require.NoError(t, index.Close())
+
+		_, err = OpenIndex(ctx, "sqlite:", dir, "")
+		require.Error(t, err)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), sqliteFileName)
+		testConcurrentMigrations(t, func() (*sqlIndex, error) {
+			return openSqliteIndex(path, "")
+		})
+	})
+}
+
+func TestMigratePostgresConcurrent(t *testing.T) {
+	ctx := testcontext.New(t)
+	c := os.Getenv("STORE_TEST_CONN")
+	if c == "" {
+		t.Skip("STORE_TEST_CONN is not set (e.g. postgres://postgres@localhost:5432/storage)")
+	}
+	schemaName := "largefile-" + pgutil.CreateRandomTestingSchemaName(8)
+	connStrWithSchema := pgutil.ConnstrWithSchema(c, schemaName)
+	db, err := sql.Open("pgx", connStrWithSchema)
+	require.NoError(t, err)
+	defer ctx.Check(db.Close)
+	require.NoError(t, pgutil.CreateSchema(ctx, db, schemaName))
+	defer func() { require.NoError(t, pgutil.DropSchema(ctx, db, schemaName)) }()
+
+	testConcurrentMigrations(t, func() (*sqlIndex, error) {
+		return openPostgresIndex(connStrWithSchema, "")
+	})
+}
+
+// testConcurrentMigrations migrates the same database from several stores at once.
+func testConcurrentMigrations(t *testing.T, open func() (*sqlIndex, error)) {
+	ctx := context.Background()
+	var indexes []*sqlIndex
+	for i := 0; i < 5; i++ {
+		index, err := open()
+		require.NoError(t, err)
+		defer func() { require.NoError(t, index.Close()) }()
+		// connect before the migrations, the stores are opened one by one (SQLite switches a new
+		// database to WAL mode without waiting for the lock)
+		require.NoError(t, index.db.PingContext(ctx))
+		indexes = append(indexes, index)
+	}
+
+	errs := make([]error, len(indexes))
+	var wg sync.WaitGroup
+	for i, index := range indexes {
+		wg.Add(1)
+		go func(i int, index *sqlIndex) {
+			defer wg.Done()
+			errs[i] = index.Migrate(ctx)
+		}(i, index)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	status, err := indexes[0].SchemaStatus(ctx)
+	require.NoError(t, err)
+	require.Equal(t, LatestSchemaVersion, status.Current)
+	var applied int
+	require.NoError(t, indexes[0].db.QueryRowContext(ctx, "SELECT count(*) FROM "+versionTable).Scan(&applied))
+	require.Equal(t, len(migrations), applied)
+}
+
+func TestLargeOffsets(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("large")}
+		slot := Slot{File: "large", Start: 3 << 30, Size: 5 << 30}
+		require.NoError(t, store.index.Insert(ctx, ref, slot))
+		piece, err := store.index.Get(ctx, ref)
+		require.NoError(t, err)
+		require.Equal(t, slot.Start, piece.Slot.Start)
+		require.Equal(t, slot.Size, piece.Slot.Size)
+		require.Equal(t, slot.Size, piece.Size)
+	})
+}
@@ -1,7 +1,7 @@
 package largefile
 
 import (
-	"database/sql"
+	"context"
 	"github.com/pkg/errors"
 	"io"
 	"os"
@@ -10,49 +10,52 @@ import (
 	"storj.io/storj/storagenode/blobstore/filestore"
 )
 
+// reader reads the byte range of a piece with positional reads only. It behaves like an *os.File
+// of size bytes.
 type reader struct {
-	offset     int64
-	size       int64
-	source     *os.File
-	virtualPos int64
+	offset   int64
+	size     int64
+	source   *os.File
+	pos      int64
+	checksum *uint32
+
+	// files and cached are set if the source is shared with other readers.
+	files  *fileCache
+	cached *cachedFile
 }
 
 var _ blobstore.BlobReader = &reader{}
 
-func NewReader(db *sql.DB, dir string, ref blobstore.BlobRef) (*reader, error) {
-	var file string
-	var size int64
-	var offset int64
-
-	rows, err := db.Query("select file,slots.size,start from pieces JOIN slots ON pieces.slot_id = slots.id where namespace=$1 AND key=$2 AND NOT trash", ref.Namespace, ref.Key)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	defer rows.Close()
-	if !rows.Next() {
-		return nil, os.ErrNotExist
-	}
-	err = rows.Scan(&file, &size, &offset)
+// NewReader opens the piece through the file cache. The access is recorded by the tracker, if any.
+func NewReader(ctx context.Context, index Index, files *fileCache, access *accessTracker, ref blobstore.BlobRef) (*reader, error) {
+	piece, err := index.Get(ctx, ref)
 	if err != nil {
 		return nil, err
 	}
-	source, err := os.Open(filepath.Join(dir, file))
+	cached, err := files.open(piece.Slot.File)
+	if os.IsNotExist(err) {
+		// the file may have been compacted since the lookup
+		piece, err = index.Get(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		cached, err = files.open(piece.Slot.File)
+	}
 	if err != nil {
 		return nil, err
 	}
-	if offset > 0 {
-		source.Seek(offset, 0)
-	}
 
-	_, err = db.Exec("update pieces SET accessed = current_timestamp where namespace=$1 AND key=$2", ref.Namespace, ref.Key)
-	if err != nil {
-		return nil, errors.WithStack(err)
+	if access != nil {
+		access.touch(piece)
 	}
 
 	return &reader{
-		source: source,
-		size:   size,
-		offset: offset,
+		source:   cached.file,
+		size:     piece.Slot.Size,
+		offset:   piece.Slot.Start,
+		checksum: piece.Slot.Checksum,
+		files:    files,
+		cached:   cached,
 	}, nil
 }
 
@@ -61,9 +64,6 @@ func NewReaderFromEntry(dir string, sourceFile string, size int64, offset int64)
 	if err != nil {
 		return nil, err
 	}
-	if offset > 0 {
-		source.Seek(offset, 0)
-	}
 	return &reader{
 		source: source,
 		size:   size,
@@ -72,42 +72,81 @@ func NewReaderFromEntry(dir string, sourceFile string, size int64, offset int64)
 }
 
 func (r *reader) Read(p []byte) (n int, err error) {
-	if r.virtualPos > r.size {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if r.pos >= r.size {
 		return 0, io.EOF
 	}
-	read, err := r.source.Read(p)
-	if int64(read)+r.virtualPos > r.size {
-		read = int(r.size - r.virtualPos)
+	if rest := r.size - r.pos; int64(len(p)) > rest {
+		// the rest of the segment belongs to other pieces
+		p = p[:rest]
 	}
-	r.virtualPos += int64(read)
-	return read, err
+	n, err = r.readAt(p, r.offset+r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
 }
 
 func (r *reader) ReadAt(p []byte, off int64) (n int, err error) {
-	at, err := r.source.ReadAt(p, off)
-	r.virtualPos = off + int64(at)
-	if int64(at)+r.virtualPos > r.size {
-		at = int(r.size - r.virtualPos)
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if off >= r.size {
+		return 0, io.EOF
 	}
-	return at, err
+	limited := p
+	if rest := r.size - off; int64(len(p)) > rest {
+		limited = p[:rest]
+	}
+	n, err = r.readAt(limited, r.offset+off)
+	if err == nil && len(limited) < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// readAt reads from the memory mapped file if possible, otherwise from the file.
+func (r *reader) readAt(p []byte, off int64) (int, error) {
+	if r.cached != nil && r.cached.data != nil && r.cached.readMapped(p, off) {
+		return len(p), nil
+	}
+	return r.source.ReadAt(p, off)
 }
 
 func (r *reader) Seek(offset int64, whence int) (int64, error) {
 	switch whence {
-	case 0:
-		r.virtualPos = r.offset
-		return r.source.Seek(offset+r.offset, whence)
-
-	case 1:
-		r.virtualPos += offset
-		return r.source.Seek(offset, whence)
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
 	default:
 		return 0, errors.New("Unsupported whence")
 	}
+	if offset < 0 {
+		return 0, errors.New("Negative position")
+	}
+	r.pos = offset
+	return r.pos, nil
 }
 
+// Close releases the source. Closing again is a no-op, the reads fail after the first Close.
 func (r *reader) Close() error {
-	return r.source.Close()
+	if r.source == nil {
+		return nil
+	}
+	source, cached := r.source, r.cached
+	r.source, r.cached = nil, nil
+	if cached != nil {
+		return r.files.release(cached)
+	}
+	return source.Close()
 }
 
 func (r *reader) Size() (int64, error) {
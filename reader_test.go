@@ -0,0 +1,127 @@
+package largefile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"io"
+	"math/rand"
+	"storj.io/common/testrand"
+	"storj.io/storj/storagenode/blobstore"
+	"storj.io/storj/storagenode/blobstore/filestore"
+	"testing"
+)
+
+// TestReaderDifferential executes the same random operations on a filestore and a largefile reader.
+func TestReaderDifferential(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		fs, err := filestore.NewAt(zaptest.NewLogger(t), t.TempDir(), filestore.DefaultConfig)
+		require.NoError(t, err)
+
+		write := func(store blobstore.Blobs, ref blobstore.BlobRef, data []byte) {
+			w, err := store.Create(ctx, ref, int64(len(data)))
+			require.NoError(t, err)
+			_, err = w.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, w.Commit(ctx))
+		}
+
+		// neighbours in the same segment
+		write(store, blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("before")}, testrand.BytesInt(777))
+		ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("piece")}
+		data := testrand.BytesInt(1000)
+		write(store, ref, data)
+		write(fs, ref, data)
+		write(store, blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("after")}, testrand.BytesInt(555))
+
+		expected, err := fs.Open(ctx, ref)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, expected.Close()) }()
+		actual, err := store.Open(ctx, ref)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, actual.Close()) }()
+
+		size := int64(len(data))
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < 1000; i++ {
+			var desc string
+			var expectedResult, actualResult string
+			switch rnd.Intn(3) {
+			case 0:
+				length := rnd.Intn(300)
+				desc = fmt.Sprintf("Read(%d)", length)
+				expectedBuf, actualBuf := make([]byte, length), make([]byte, length)
+				expectedN, expectedErr := expected.Read(expectedBuf)
+				actualN, actualErr := actual.Read(actualBuf)
+				expectedResult = readResult(expectedN, expectedErr)
+				actualResult = readResult(actualN, actualErr)
+				if expectedN == actualN {
+					require.Equal(t, expectedBuf[:expectedN], actualBuf[:actualN], desc)
+				}
+			case 1:
+				length := rnd.Intn(300)
+				off := rnd.Int63n(size+100) - 10
+				desc = fmt.Sprintf("ReadAt(%d, %d)", length, off)
+				expectedBuf, actualBuf := make([]byte, length), make([]byte, length)
+				expectedResult = readResult(expected.ReadAt(expectedBuf, off))
+				actualResult = readResult(actual.ReadAt(actualBuf, off))
+				require.Equal(t, expectedBuf, actualBuf, desc)
+			case 2:
+				whence := rnd.Intn(3)
+				offset := rnd.Int63n(2*size+100) - size - 50
+				desc = fmt.Sprintf("Seek(%d, %d)", offset, whence)
+				expectedResult = seekResult(expected.Seek(offset, whence))
+				actualResult = seekResult(actual.Seek(offset, whence))
+			}
+			require.Equal(t, expectedResult, actualResult, "operation %d: %s", i, desc)
+		}
+	})
+}
+
+func TestReaderCloseTwice(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("piece")}
+		data := testrand.BytesInt(1000)
+		w, err := store.Create(ctx, ref, int64(len(data)))
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Commit(ctx))
+
+		first, err := store.Open(ctx, ref)
+		require.NoError(t, err)
+		second, err := store.Open(ctx, ref)
+		require.NoError(t, err)
+
+		require.NoError(t, first.Close())
+		require.NoError(t, first.Close())
+		_, err = first.Read(make([]byte, 1))
+		require.Error(t, err)
+
+		// the shared file is still open for the other reader
+		content, err := io.ReadAll(second)
+		require.NoError(t, err)
+		require.Equal(t, data, content)
+		require.NoError(t, second.Close())
+	})
+}
+
+func readResult(n int, err error) string {
+	switch {
+	case err == nil:
+		return fmt.Sprintf("%d", n)
+	case errors.Is(err, io.EOF):
+		return fmt.Sprintf("%d EOF", n)
+	default:
+		return fmt.Sprintf("%d error", n)
+	}
+}
+
+func seekResult(pos int64, err error) string {
+	if err != nil {
+		return "error"
+	}
+	return fmt.Sprintf("%d", pos)
+}
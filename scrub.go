@@ -0,0 +1,236 @@
+package largefile
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/zeebo/errs"
+	"go.uber.org/zap"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"storj.io/common/sync2"
+	"time"
+)
+
+// quarantineDir is the subdirectory (relative to the store dir) of the pieces removed by the scrub.
+const quarantineDir = "quarantine"
+
+// scrubBatch is the number of pieces listed from the index at once.
+const scrubBatch = 1000
+
+// ScrubConfig defines how the stored pieces are verified.
+type ScrubConfig struct {
+	// BytesPerSecond limits the read throughput, 0 means unlimited.
+	BytesPerSecond int64
+	// Sample is the probability of verifying a piece, 0 means all the pieces are verified.
+	Sample float64
+	// ProgressFile stores the position of the last verified piece, to continue an interrupted pass.
+	ProgressFile string
+	// Quarantine moves the data of the failed pieces to the quarantine directory and deletes them.
+	Quarantine bool
+}
+
+// ScrubFailure is a piece which couldn't be read back or doesn't match its size or checksum.
+type ScrubFailure struct {
+	Piece Piece
+	Err   error
+}
+
+// ScrubStats summarizes one scrub pass.
+type ScrubStats struct {
+	Checked int
+	Skipped int
+	// Unverified is the number of checked pieces without checksum (only the size is verified).
+	Unverified int
+	Bytes      int64
+	Failed     []ScrubFailure
+}
+
+type scrubProgress struct {
+	File  string `json:"file"`
+	Start int64  `json:"start"`
+	ID    int64  `json:"id"`
+}
+
+// Scrub re-reads the non-trashed pieces in physical order and verifies their size and checksum.
+// With a progress file, an interrupted pass is continued after the last verified batch; the file is
+// removed when the pass is finished.
+func (b *LargeFileStore) Scrub(ctx context.Context, log *zap.Logger, config ScrubConfig) (stats ScrubStats, err error) {
+	position := scrubProgress{Start: -1}
+	if config.ProgressFile != "" {
+		raw, err := os.ReadFile(config.ProgressFile)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(raw, &position); err != nil {
+				return stats, errs.New("invalid scrub progress file %s: %v", config.ProgressFile, err)
+			}
+		case !os.IsNotExist(err):
+			return stats, errors.WithStack(err)
+		}
+	}
+
+	limiter := rateLimiter{limit: config.BytesPerSecond, start: time.Now()}
+	for {
+		pieces, err := b.index.ListSlots(ctx, Slot{File: position.File, Start: position.Start, ID: position.ID}, scrubBatch)
+		if err != nil {
+			return stats, err
+		}
+		if len(pieces) == 0 {
+			break
+		}
+		for _, piece := range pieces {
+			if config.Sample > 0 && rand.Float64() >= config.Sample {
+				stats.Skipped++
+				continue
+			}
+			read, verifyErr := b.verifyPiece(ctx, piece, &limiter)
+			if ctx.Err() != nil {
+				return stats, ctx.Err()
+			}
+			stats.Checked++
+			stats.Bytes += read
+			if piece.Slot.Checksum == nil {
+				stats.Unverified++
+			}
+			if verifyErr == nil {
+				continue
+			}
+
+			// compaction may have moved (or a client deleted) the piece in the meantime
+			current, err := b.index.Get(ctx, piece.Ref)
+			if errors.Is(err, os.ErrNotExist) || (err == nil && current.Slot.ID != piece.Slot.ID) {
+				continue
+			}
+			if err != nil {
+				return stats, err
+			}
+
+			log.Warn("piece verification is failed",
+				zap.Binary("namespace", piece.Ref.Namespace),
+				zap.Binary("key", piece.Ref.Key),
+				zap.String("file", piece.Slot.File),
+				zap.Int64("start", piece.Slot.Start),
+				zap.Error(verifyErr))
+			stats.Failed = append(stats.Failed, ScrubFailure{
+				Piece: piece,
+				Err:   verifyErr,
+			})
+			if config.Quarantine {
+				err = b.quarantine(ctx, piece)
+				if err != nil {
+					return stats, err
+				}
+			}
+		}
+
+		last := pieces[len(pieces)-1]
+		position = scrubProgress{File: last.Slot.File, Start: last.Slot.Start, ID: last.Slot.ID}
+		if config.ProgressFile != "" {
+			raw, err := json.Marshal(position)
+			if err != nil {
+				return stats, errors.WithStack(err)
+			}
+			err = writeFileSync(config.ProgressFile+".tmp", raw)
+			if err != nil {
+				return stats, err
+			}
+			err = os.Rename(config.ProgressFile+".tmp", config.ProgressFile)
+			if err != nil {
+				return stats, errors.WithStack(err)
+			}
+		}
+	}
+
+	if config.ProgressFile != "" {
+		err = os.Remove(config.ProgressFile)
+		if err != nil && !os.IsNotExist(err) {
+			return stats, errors.WithStack(err)
+		}
+	}
+	return stats, nil
+}
+
+// verifyPiece reads the slot of the piece and compares it with the recorded size and checksum.
+func (b *LargeFileStore) verifyPiece(ctx context.Context, piece Piece, limiter *rateLimiter) (read int64, err error) {
+	r, err := NewReaderFromEntry(b.dir, piece.Slot.File, piece.Slot.Size, piece.Slot.Start)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer func() {
+		err = errs.Combine(err, r.Close())
+	}()
+
+	hash := crc32.New(castagnoli)
+	buf := make([]byte, 64*1024)
+	for {
+		n, readErr := r.Read(buf)
+		_, _ = hash.Write(buf[:n])
+		read += int64(n)
+		if err := limiter.wait(ctx, n); err != nil {
+			return read, err
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return read, errors.WithStack(readErr)
+		}
+	}
+	if read != piece.Slot.Size {
+		return read, ErrCorruption.New("size mismatch of piece in %s at %d (expected %d, read %d)", piece.Slot.File, piece.Slot.Start, piece.Slot.Size, read)
+	}
+	if piece.Slot.Checksum != nil && *piece.Slot.Checksum != hash.Sum32() {
+		return read, ErrCorruption.New("checksum mismatch of piece in %s at %d (expected %08x, actual %08x)", piece.Slot.File, piece.Slot.Start, *piece.Slot.Checksum, hash.Sum32())
+	}
+	return read, nil
+}
+
+// quarantine saves the (readable part of the) data of the piece to the quarantine directory, for
+// later investigation, and deletes the piece.
+func (b *LargeFileStore) quarantine(ctx context.Context, piece Piece) error {
+	dir := filepath.Join(b.dir, quarantineDir, PathEncoding.EncodeToString(piece.Ref.Namespace))
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	dst, err := os.Create(filepath.Join(dir, PathEncoding.EncodeToString(piece.Ref.Key)))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	src, err := os.Open(filepath.Join(b.dir, piece.Slot.File))
+	if err == nil {
+		_, err = io.Copy(dst, io.NewSectionReader(src, piece.Slot.Start, piece.Slot.Size))
+		err = errs.Combine(errors.WithStack(err), src.Close())
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	err = errs.Combine(errors.WithStack(err), dst.Close())
+	if err != nil {
+		return err
+	}
+	return b.Delete(ctx, piece.Ref)
+}
+
+// rateLimiter delays the caller to keep the average throughput under the limit.
+type rateLimiter struct {
+	limit int64
+	start time.Time
+	bytes int64
+}
+
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l.limit <= 0 {
+		return nil
+	}
+	l.bytes += int64(n)
+	expected := time.Duration(float64(l.bytes) / float64(l.limit) * float64(time.Second))
+	if delay := expected - time.Since(l.start); delay > 0 {
+		if !sync2.Sleep(ctx, delay) {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package largefile
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"os"
+	"path/filepath"
+	"storj.io/common/testrand"
+	"storj.io/storj/storagenode/blobstore"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		var refs []blobstore.BlobRef
+		for i := 0; i < 10; i++ {
+			ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: testrand.Bytes(32)}
+			data := testrand.BytesInt(1000)
+			w, err := store.Create(ctx, ref, int64(len(data)))
+			require.NoError(t, err)
+			_, err = w.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, w.Commit(ctx))
+			refs = append(refs, ref)
+		}
+
+		stats, err := store.Scrub(ctx, zaptest.NewLogger(t), ScrubConfig{})
+		require.NoError(t, err)
+		require.Equal(t, 10, stats.Checked)
+		require.Equal(t, int64(10000), stats.Bytes)
+		require.Empty(t, stats.Failed)
+
+		corrupted, err := store.index.Get(ctx, refs[5])
+		require.NoError(t, err)
+		f, err := os.OpenFile(filepath.Join(store.dir, corrupted.Slot.File), os.O_RDWR, 0644)
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte("corrupted"), corrupted.Slot.Start+100)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		// continue after the third piece
+		pieces, err := store.index.ListSlots(ctx, Slot{Start: -1}, 3)
+		require.NoError(t, err)
+		progress := filepath.Join(t.TempDir(), "scrub.progress")
+		raw, err := json.Marshal(scrubProgress{File: pieces[2].Slot.File, Start: pieces[2].Slot.Start, ID: pieces[2].Slot.ID})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(progress, raw, 0644))
+
+		stats, err = store.Scrub(ctx, zaptest.NewLogger(t), ScrubConfig{
+			ProgressFile: progress,
+			Quarantine:   true,
+		})
+		require.NoError(t, err)
+		require.Equal(t, 7, stats.Checked)
+		require.Len(t, stats.Failed, 1)
+		require.True(t, ErrCorruption.Has(stats.Failed[0].Err))
+		require.Equal(t, refs[5], stats.Failed[0].Piece.Ref)
+
+		_, err = os.Stat(progress)
+		require.True(t, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(store.dir, quarantineDir, PathEncoding.EncodeToString(refs[5].Namespace), PathEncoding.EncodeToString(refs[5].Key)))
+		require.NoError(t, err)
+		_, err = store.index.Get(ctx, refs[5])
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestListSlotsSameStart(t *testing.T) {
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		// empty pieces share the start of the next slot
+		for i := 0; i < 5; i++ {
+			w, err := store.Create(ctx, blobstore.BlobRef{Namespace: []byte("ns"), Key: testrand.Bytes(32)}, 0)
+			require.NoError(t, err)
+			require.NoError(t, w.Commit(ctx))
+		}
+		w, err := store.Create(ctx, blobstore.BlobRef{Namespace: []byte("ns"), Key: testrand.Bytes(32)}, 100)
+		require.NoError(t, err)
+		_, err = w.Write(testrand.BytesInt(100))
+		require.NoError(t, err)
+		require.NoError(t, w.Commit(ctx))
+
+		listed := map[int64]bool{}
+		starts := map[int64]bool{}
+		after := Slot{Start: -1}
+		for {
+			pieces, err := store.index.ListSlots(ctx, after, 2)
+			require.NoError(t, err)
+			if len(pieces) == 0 {
+				break
+			}
+			for _, piece := range pieces {
+				require.False(t, listed[piece.Slot.ID])
+				listed[piece.Slot.ID] = true
+				starts[piece.Slot.Start] = true
+			}
+			after = pieces[len(pieces)-1].Slot
+		}
+		require.Len(t, listed, 6)
+		require.Less(t, len(starts), 6)
+
+		stats, err := store.Scrub(ctx, zaptest.NewLogger(t), ScrubConfig{})
+		require.NoError(t, err)
+		require.Equal(t, 6, stats.Checked)
+	})
+}
@@ -0,0 +1,366 @@
+package largefile
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// segmentDir is the subdirectory (relative to the store dir) of the shared segment files.
+const segmentDir = "segments"
+
+const segmentExt = ".seg"
+
+// maxSegmentSize is the size after which no new region is reserved in a segment.
+const maxSegmentSize = 1 << 30
+
+// segment is a large file shared by many pieces.
+type segment struct {
+	name   string
+	file   *os.File
+	tail   int64
+	refs   int
+	sealed bool
+	// trim is set if the file may be longer than the tail, because of the preallocated space of the
+	// released regions.
+	trim bool
+}
+
+// region is a reserved byte range inside a segment, owned by exactly one writer.
+type region struct {
+	seg   *segment
+	start int64
+	cap   int64
+}
+
+// segments hands out regions of the active segment file.
+type segments struct {
+	mu     sync.Mutex
+	dir    string
+	next   int64
+	active *segment
+	// open contains the segments which are written by a writer or the compaction.
+	open map[string]*segment
+
+	// unused is the reserved but not yet written capacity of the regions (updated atomically).
+	unused int64
+
+	syncMode  SyncMode
+	syncDelay time.Duration
+	// syncing are the segments waiting for the next batched flush, with the channels of the waiting
+	// commits.
+	syncing map[*segment][]chan error
+	syncer  bool
+}
+
+func newSegments(dir string, syncMode SyncMode, syncDelay time.Duration) (*segments, error) {
+	err := os.MkdirAll(filepath.Join(dir, segmentDir), 0755)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, segmentDir))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var next int64
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(e.Name(), segmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+		if id >= next {
+			next = id + 1
+		}
+	}
+	return &segments{
+		dir:       dir,
+		next:      next,
+		open:      map[string]*segment{},
+		syncMode:  syncMode,
+		syncDelay: syncDelay,
+		syncing:   map[*segment][]chan error{},
+	}, nil
+}
+
+// reserve returns a new region with the given capacity at the tail of the active segment. The disk
+// space of the region is allocated up front.
+func (s *segments) reserve(size int64) (*region, error) {
+	s.mu.Lock()
+	r, err := s.reserveLocked(size)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	err = preallocate(r.seg.file, r.start, r.cap)
+	if err != nil {
+		s.release(r, 0)
+		return nil, err
+	}
+	return r, nil
+}
+
+func (s *segments) reserveLocked(size int64) (*region, error) {
+	if size < 0 {
+		size = 0
+	}
+	if s.active == nil || s.active.tail >= maxSegmentSize {
+		if err := s.rotateLocked(); err != nil {
+			return nil, err
+		}
+	}
+	seg := s.active
+	seg.trim = true
+	r := &region{
+		seg:   seg,
+		start: seg.tail,
+		cap:   size,
+	}
+	seg.tail += size
+	seg.refs++
+	atomic.AddInt64(&s.unused, size)
+	return r, nil
+}
+
+func (s *segments) rotateLocked() error {
+	if s.active != nil {
+		s.sealLocked(s.active)
+		s.active = nil
+	}
+	seg, err := s.createLocked()
+	if err != nil {
+		return err
+	}
+	s.active = seg
+	return nil
+}
+
+func (s *segments) createLocked() (*segment, error) {
+	name := filepath.Join(segmentDir, fmt.Sprintf("%016x%s", s.next, segmentExt))
+	file, err := os.OpenFile(filepath.Join(s.dir, name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s.next++
+	if s.syncMode != SyncNone {
+		// the new directory entry should survive a crash together with the data
+		err = syncDir(filepath.Join(s.dir, segmentDir))
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	seg := &segment{
+		name: name,
+		file: file,
+	}
+	s.open[name] = seg
+	return seg, nil
+}
+
+// sealLocked marks the segment as read-only. The file is closed when the last writer is done.
+func (s *segments) sealLocked(seg *segment) {
+	seg.sealed = true
+	if seg.refs == 0 {
+		s.closeLocked(seg)
+	}
+}
+
+// closeLocked closes the file of the sealed segment which is not written anymore.
+func (s *segments) closeLocked(seg *segment) {
+	if seg.trim {
+		_ = seg.file.Truncate(seg.tail)
+	}
+	_ = seg.file.Close()
+	delete(s.open, seg.name)
+}
+
+// create returns a new segment which is not used for reservations. It's sealed by release.
+func (s *segments) create() (*region, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seg, err := s.createLocked()
+	if err != nil {
+		return nil, err
+	}
+	seg.sealed = true
+	seg.refs++
+	return &region{
+		seg: seg,
+	}, nil
+}
+
+// inUse returns true if the file is a segment which can still be modified.
+func (s *segments) inUse(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.open[name]
+	return found
+}
+
+// grow makes sure that the region can hold at least size bytes. The region is extended in place
+// if nobody reserved space after it, otherwise the first written bytes are moved to a new region
+// and the old one is left behind as a hole.
+func (s *segments) grow(r *region, size int64, written int64) error {
+	s.mu.Lock()
+	if r.seg.tail == r.start+r.cap {
+		r.seg.tail = r.start + size
+		extended := r.start + r.cap
+		atomic.AddInt64(&s.unused, size-r.cap)
+		r.cap = size
+		s.mu.Unlock()
+		return preallocate(r.seg.file, extended, r.start+size-extended)
+	}
+	capacity := 2 * r.cap
+	if capacity < size {
+		capacity = size
+	}
+	moved, err := s.reserveLocked(capacity)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = preallocate(moved.seg.file, moved.start, moved.cap)
+	if err != nil {
+		s.release(moved, 0)
+		return err
+	}
+
+	if written > 0 {
+		_, err = copyRange(moved.seg.file, moved.start, r.seg.file, r.start, written)
+		if err != nil {
+			s.release(moved, 0)
+			return err
+		}
+		s.written(written)
+	}
+	s.release(r, written)
+	*r = *moved
+	return nil
+}
+
+// release gives back the unused part of the region, and frees its preallocated disk space. Bytes up
+// to written may contain data and are never handed out again; they remain as a hole until the
+// segment is compacted.
+func (s *segments) release(r *region, written int64) {
+	if written < r.cap {
+		atomic.AddInt64(&s.unused, -(r.cap - written))
+		// the range is still owned by the region, nobody else writes it
+		_ = deallocate(r.seg.file, r.start+written, r.cap-written)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seg := r.seg
+	if seg.tail == r.start+r.cap && written < r.cap {
+		seg.tail = r.start + written
+	}
+	seg.refs--
+	if seg.sealed && seg.refs == 0 {
+		s.closeLocked(seg)
+	}
+}
+
+// written records that n bytes of the reserved capacity are written.
+func (s *segments) written(n int64) {
+	atomic.AddInt64(&s.unused, -n)
+}
+
+// reserved returns the reserved but not yet written capacity of the regions.
+func (s *segments) reserved() int64 {
+	return atomic.LoadInt64(&s.unused)
+}
+
+// sync flushes the data written to the region according to the sync mode. The region should not be
+// released before the sync returns.
+func (s *segments) sync(r *region) error {
+	switch s.syncMode {
+	case SyncNone:
+		return nil
+	case SyncBatch:
+		done := make(chan error, 1)
+		s.mu.Lock()
+		s.syncing[r.seg] = append(s.syncing[r.seg], done)
+		if !s.syncer {
+			s.syncer = true
+			go s.batchSync()
+		}
+		s.mu.Unlock()
+		return <-done
+	default:
+		return errors.WithStack(r.seg.file.Sync())
+	}
+}
+
+// batchSync flushes the segments of the waiting commits, until there are no more waiting commits.
+func (s *segments) batchSync() {
+	for {
+		time.Sleep(s.syncDelay)
+		s.mu.Lock()
+		syncing := s.syncing
+		s.syncing = map[*segment][]chan error{}
+		if len(syncing) == 0 {
+			s.syncer = false
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		for seg, waiting := range syncing {
+			mon.IntVal("batch_sync_commits").Observe(int64(len(waiting)))
+			err := errors.WithStack(seg.file.Sync())
+			for _, done := range waiting {
+				done <- err
+			}
+		}
+	}
+}
+
+func (s *segments) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active == nil {
+		return nil
+	}
+	s.sealLocked(s.active)
+	s.active = nil
+	return nil
+}
+
+// copyRange copies size bytes between two positions using positional reads and writes only. It
+// returns the checksum of the copied bytes.
+func copyRange(dst *os.File, dstOffset int64, src *os.File, srcOffset int64, size int64) (uint32, error) {
+	var checksum uint32
+	buf := make([]byte, 64*1024)
+	for size > 0 {
+		chunk := buf
+		if int64(len(chunk)) > size {
+			chunk = chunk[:size]
+		}
+		n, err := src.ReadAt(chunk, srcOffset)
+		if n < len(chunk) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, errors.WithStack(err)
+		}
+		checksum = crc32.Update(checksum, castagnoli, chunk)
+		_, err = dst.WriteAt(chunk, dstOffset)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		srcOffset += int64(n)
+		dstOffset += int64(n)
+		size -= int64(n)
+	}
+	return checksum, nil
+}
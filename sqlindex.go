@@ -0,0 +1,709 @@
+package largefile
+
+import (
+	"context"
+	"database/sql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"github.com/zeebo/errs"
+	"os"
+	"storj.io/storj/storagenode/blobstore"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sqliteFileName = "metadata.db"
+
+// groupCommitBatch is the maximum number of pieces inserted in one transaction.
+const groupCommitBatch = 1000
+
+// sqlIndex stores the metadata in Postgres or SQLite.
+type sqlIndex struct {
+	db     *sql.DB
+	sqlite bool
+	// instance separates the rows of the stores sharing the same database.
+	instance string
+
+	// mu protects the inserts waiting for the next group commit. committed is closed when the
+	// running committer exits, nil if there is no committer.
+	mu        sync.Mutex
+	pending   []*pendingInsert
+	committed chan struct{}
+	closed    bool
+}
+
+// pendingInsert is a piece waiting for the group commit. The result is sent to done.
+type pendingInsert struct {
+	ref  blobstore.BlobRef
+	slot Slot
+	done chan error
+}
+
+var _ Index = &sqlIndex{}
+
+func openPostgresIndex(connDef string, instance string) (*sqlIndex, error) {
+	db, err := sql.Open("pgx", connDef)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &sqlIndex{
+		db:       db,
+		instance: instance,
+	}, nil
+}
+
+func openSqliteIndex(path string, instance string) (*sqlIndex, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=10000&_journal_mode=WAL&_txlock=immediate")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &sqlIndex{
+		db:       db,
+		sqlite:   true,
+		instance: instance,
+	}, nil
+}
+
+// q converts the Postgres style placeholders to the dialect of the database.
+func (s *sqlIndex) q(query string) string {
+	if s.sqlite {
+		return strings.ReplaceAll(query, "$", "?")
+	}
+	return query
+}
+
+// Insert saves the slot and the piece in one transaction, which is shared with the concurrent
+// inserts: an insert is committed immediately if no transaction is running, otherwise together with
+// the others arriving during the running transaction. It returns when the transaction is committed.
+// A canceled context fails the insert only if it's not yet part of a transaction, as the result of
+// a running transaction is unknown until the commit.
+func (s *sqlIndex) Insert(ctx context.Context, ref blobstore.BlobRef, slot Slot) error {
+	insert := &pendingInsert{
+		ref:  ref,
+		slot: slot,
+		done: make(chan error, 1),
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errs.New("index is closed")
+	}
+	s.pending = append(s.pending, insert)
+	if s.committed == nil {
+		s.committed = make(chan struct{})
+		go s.groupCommit(s.committed)
+	}
+	s.mu.Unlock()
+
+	select {
+	case err := <-insert.done:
+		return err
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	for i, pending := range s.pending {
+		if pending == insert {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			s.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	s.mu.Unlock()
+	return <-insert.done
+}
+
+// groupCommit inserts the pending pieces in batches, until there are no more waiting inserts.
+func (s *sqlIndex) groupCommit(committed chan struct{}) {
+	defer close(committed)
+	for {
+		s.mu.Lock()
+		batch := s.pending
+		if len(batch) > groupCommitBatch {
+			batch = batch[:groupCommitBatch]
+		}
+		s.pending = s.pending[len(batch):]
+		if len(batch) == 0 {
+			s.committed = nil
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		mon.IntVal("group_commit_batch").Observe(int64(len(batch)))
+		results, err := s.insertBatch(context.Background(), batch)
+		for i, insert := range batch {
+			if err != nil {
+				insert.done <- err
+			} else {
+				insert.done <- results[i]
+			}
+		}
+	}
+}
+
+// insertBatch inserts the pieces in one transaction. Each piece is inserted under a savepoint, so a
+// failing piece (e.g. an existing key) doesn't fail the others: its error is returned in results.
+func (s *sqlIndex) insertBatch(ctx context.Context, batch []*pendingInsert) (results []error, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			err = errs.Combine(err, tx.Rollback())
+		} else {
+			err = errors.WithStack(tx.Commit())
+		}
+	}()
+
+	results = make([]error, len(batch))
+	for i, insert := range batch {
+		_, err = tx.ExecContext(ctx, "SAVEPOINT piece_insert")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		results[i] = s.insertPiece(ctx, tx, insert.ref, insert.slot)
+		if results[i] != nil {
+			_, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT piece_insert")
+		} else {
+			_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT piece_insert")
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return results, nil
+}
+
+func (s *sqlIndex) insertPiece(ctx context.Context, tx *sql.Tx, ref blobstore.BlobRef, slot Slot) error {
+	var id int64
+	err := tx.QueryRowContext(ctx, s.q("INSERT INTO slots (file,size,start,checksum,instance) VALUES ($1,$2,$3,$4,$5) RETURNING id"),
+		slot.File,
+		slot.Size,
+		slot.Start,
+		slot.Checksum,
+		s.instance).Scan(&id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = tx.ExecContext(ctx, s.q("INSERT INTO pieces (namespace,key,size,slot_id,instance) VALUES ($1,$2,$3,$4,$5)"),
+		ref.Namespace,
+		ref.Key,
+		slot.Size,
+		id,
+		s.instance)
+	return errors.WithStack(err)
+}
+
+func (s *sqlIndex) GetMeta(ctx context.Context, name string) (value string, err error) {
+	err = s.db.QueryRowContext(ctx, s.q("SELECT value FROM largefile_meta WHERE name = $1 AND instance = $2"), name, s.instance).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", os.ErrNotExist
+	}
+	return value, errors.WithStack(err)
+}
+
+func (s *sqlIndex) SetMetas(ctx context.Context, values map[string]string) (err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			err = errs.Combine(err, tx.Rollback())
+		} else {
+			err = errors.WithStack(tx.Commit())
+		}
+	}()
+	for name, value := range values {
+		_, err = tx.ExecContext(ctx, s.q("INSERT INTO largefile_meta (name, value, instance) VALUES ($1, $2, $3) ON CONFLICT (instance, name) DO UPDATE SET value = excluded.value"), name, value, s.instance)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (s *sqlIndex) Get(ctx context.Context, ref blobstore.BlobRef) (Piece, error) {
+	p := Piece{
+		Ref: ref,
+	}
+	rows, err := s.db.QueryContext(ctx, s.q("select pieces.size,created,accessed,slots.id,file,slots.size,start,checksum from pieces JOIN slots ON pieces.slot_id = slots.id where namespace=$1 AND key=$2 AND NOT trash AND pieces.instance=$3"), ref.Namespace, ref.Key, s.instance)
+	if err != nil {
+		return p, errors.WithStack(err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return p, os.ErrNotExist
+	}
+	err = rows.Scan(&p.Size, &p.Created, &p.Accessed, &p.Slot.ID, &p.Slot.File, &p.Slot.Size, &p.Slot.Start, &p.Slot.Checksum)
+	return p, errors.WithStack(err)
+}
+
+func (s *sqlIndex) Touch(ctx context.Context, accesses []Access) (err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			err = errs.Combine(err, tx.Rollback())
+		} else {
+			err = errors.WithStack(tx.Commit())
+		}
+	}()
+	stmt, err := tx.PrepareContext(ctx, s.q("update pieces SET accessed = $3 where namespace=$1 AND key=$2 AND instance=$4"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		err = errs.Combine(err, errors.WithStack(stmt.Close()))
+	}()
+	for _, access := range accesses {
+		_, err = stmt.ExecContext(ctx, access.Ref.Namespace, access.Ref.Key, access.Time.UTC(), s.instance)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (s *sqlIndex) Delete(ctx context.Context, ref blobstore.BlobRef) (pieces []Piece, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			err = errs.Combine(err, tx.Rollback())
+		} else {
+			err = errors.WithStack(tx.Commit())
+		}
+	}()
+
+	pieces, err = s.deletePieces(ctx, tx, ref.Namespace, "DELETE FROM pieces WHERE namespace = $1 AND key = $2 AND instance = $3 RETURNING key,size,trash,trashed_at,created,accessed,slot_id", ref.Namespace, ref.Key, s.instance)
+	if err != nil {
+		return nil, err
+	}
+	return pieces, s.deleteSlots(ctx, tx, pieces)
+}
+
+func (s *sqlIndex) DeleteNamespace(ctx context.Context, namespace []byte, limit int) (pieces []Piece, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			err = errs.Combine(err, tx.Rollback())
+		} else {
+			err = errors.WithStack(tx.Commit())
+		}
+	}()
+
+	pieces, err = s.deletePieces(ctx, tx, namespace, "DELETE FROM pieces WHERE namespace = $1 AND instance = $3 AND key IN (SELECT key FROM pieces WHERE namespace = $1 AND instance = $3 LIMIT $2) RETURNING key,size,trash,trashed_at,created,accessed,slot_id", namespace, limit, s.instance)
+	if err != nil {
+		return nil, err
+	}
+	return pieces, s.deleteSlots(ctx, tx, pieces)
+}
+
+func (s *sqlIndex) Trash(ctx context.Context, ref blobstore.BlobRef) error {
+	_, err := s.db.ExecContext(ctx, s.q("UPDATE pieces SET trash = true, trashed_at = $3 WHERE namespace = $1 and key = $2 AND NOT trash AND instance = $4"), ref.Namespace, ref.Key, time.Now().UTC(), s.instance)
+	return errors.WithStack(err)
+}
+
+func (s *sqlIndex) RestoreTrash(ctx context.Context, namespace []byte) ([][]byte, error) {
+	keys := make([][]byte, 0)
+	rows, err := s.db.QueryContext(ctx, s.q("UPDATE pieces SET trash = false, trashed_at = NULL where namespace = $1 AND trash AND instance = $2 RETURNING key"), namespace, s.instance)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key []byte
+		err := rows.Scan(&key)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, errors.WithStack(rows.Err())
+}
+
+func (s *sqlIndex) EmptyTrash(ctx context.Context, namespace []byte, trashedBefore time.Time) (pieces []Piece, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			err = errs.Combine(err, tx.Rollback())
+		} else {
+			err = errors.WithStack(tx.Commit())
+		}
+	}()
+
+	pieces, err = s.deletePieces(ctx, tx, namespace, "DELETE FROM pieces WHERE namespace = $1 AND trash AND trashed_at < $2 AND instance = $3 RETURNING key,size,trash,trashed_at,created,accessed,slot_id", namespace, trashedBefore.UTC(), s.instance)
+	if err != nil {
+		return nil, err
+	}
+	return pieces, s.deleteSlots(ctx, tx, pieces)
+}
+
+// deletePieces executes a DELETE ... RETURNING key,size,trash,trashed_at,created,accessed,slot_id
+// statement and returns the deleted pieces of the namespace.
+func (s *sqlIndex) deletePieces(ctx context.Context, tx *sql.Tx, namespace []byte, query string, args ...interface{}) (pieces []Piece, err error) {
+	rows, err := tx.QueryContext(ctx, s.q(query), args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() {
+		err = errs.Combine(err, rows.Close())
+	}()
+	for rows.Next() {
+		p := Piece{
+			Ref: blobstore.BlobRef{Namespace: namespace},
+		}
+		var trashedAt *time.Time
+		err = rows.Scan(&p.Ref.Key, &p.Size, &p.Trash, &trashedAt, &p.Created, &p.Accessed, &p.Slot.ID)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if trashedAt != nil {
+			p.TrashedAt = *trashedAt
+		}
+		pieces = append(pieces, p)
+	}
+	return pieces, errors.WithStack(rows.Err())
+}
+
+// deleteSlots deletes the slots of the (already deleted) pieces, and fills the slot fields.
+func (s *sqlIndex) deleteSlots(ctx context.Context, tx *sql.Tx, pieces []Piece) error {
+	for i := range pieces {
+		slot := &pieces[i].Slot
+		err := tx.QueryRowContext(ctx, s.q("DELETE FROM slots WHERE id = $1 AND instance = $2 RETURNING file,start,size,checksum"), slot.ID, s.instance).Scan(&slot.File, &slot.Start, &slot.Size, &slot.Checksum)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (s *sqlIndex) SpaceUsedForTrash(ctx context.Context) (res int64, err error) {
+	err = s.db.QueryRowContext(ctx, s.q("SELECT coalesce(sum(size), 0) FROM pieces WHERE trash AND instance = $1"), s.instance).Scan(&res)
+	return res, errors.WithStack(err)
+}
+
+func (s *sqlIndex) SpaceUsedForTrashInNamespace(ctx context.Context, namespace []byte) (res int64, err error) {
+	err = s.db.QueryRowContext(ctx, s.q("SELECT coalesce(sum(size), 0) FROM pieces WHERE trash AND namespace = $1 AND instance = $2"), namespace, s.instance).Scan(&res)
+	return res, errors.WithStack(err)
+}
+
+func (s *sqlIndex) SpaceUsedForBlobs(ctx context.Context) (res int64, err error) {
+	var value *int64
+	err = s.db.QueryRowContext(ctx, s.q("SELECT sum(size) FROM pieces WHERE NOT trash AND instance = $1"), s.instance).Scan(&value)
+	if value != nil {
+		res = *value
+	}
+	return res, errors.WithStack(err)
+}
+
+func (s *sqlIndex) SpaceUsedForBlobsInNamespace(ctx context.Context, namespace []byte) (res int64, err error) {
+	var value *int64
+	err = s.db.QueryRowContext(ctx, s.q("SELECT sum(size) FROM pieces WHERE NOT TRASH AND namespace=$1 AND instance=$2"), namespace, s.instance).Scan(&value)
+	if value != nil {
+		res = *value
+	}
+	return res, errors.WithStack(err)
+}
+
+func (s *sqlIndex) ListNamespaces(ctx context.Context) ([][]byte, error) {
+	res := make([][]byte, 0)
+	rows, err := s.db.QueryContext(ctx, s.q("SELECT DISTINCT namespace FROM pieces WHERE instance = $1"), s.instance)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ns []byte
+		err := rows.Scan(&ns)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		res = append(res, ns)
+	}
+	return res, errors.WithStack(rows.Err())
+}
+
+func (s *sqlIndex) WalkNamespace(ctx context.Context, namespace []byte, fn func(Piece) error) error {
+	rows, err := s.db.QueryContext(ctx, s.q("SELECT namespace,key,pieces.size,created,accessed,slots.id,file,slots.size,start,checksum FROM pieces JOIN slots ON slots.id = pieces.slot_id WHERE not trash AND namespace=$1 AND pieces.instance=$2"), namespace, s.instance)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Piece
+		err = rows.Scan(&p.Ref.Namespace, &p.Ref.Key, &p.Size, &p.Created, &p.Accessed, &p.Slot.ID, &p.Slot.File, &p.Slot.Size, &p.Slot.Start, &p.Slot.Checksum)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err := fn(p)
+		if err != nil {
+			return err
+		}
+	}
+	return errors.WithStack(rows.Err())
+}
+
+func (s *sqlIndex) WalkPieces(ctx context.Context, fn func(Piece) error) error {
+	rows, err := s.db.QueryContext(ctx, s.q("SELECT namespace,key,pieces.size,slots.id,file,slots.size,start,checksum FROM pieces JOIN slots on slots.id = pieces.slot_id WHERE not trash AND pieces.instance = $1"), s.instance)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Piece
+		err = rows.Scan(&p.Ref.Namespace, &p.Ref.Key, &p.Size, &p.Slot.ID, &p.Slot.File, &p.Slot.Size, &p.Slot.Start, &p.Slot.Checksum)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err := fn(p)
+		if err != nil {
+			return err
+		}
+	}
+	return errors.WithStack(rows.Err())
+}
+
+func (s *sqlIndex) MoveSlot(ctx context.Context, ref blobstore.BlobRef, slot Slot) error {
+	var id int64
+	err := s.db.QueryRowContext(ctx, s.q("INSERT INTO slots (file,size,start,checksum,instance) VALUES ($1,$2,$3,$4,$5) RETURNING id"),
+		slot.File,
+		slot.Size,
+		slot.Start,
+		slot.Checksum,
+		s.instance).Scan(&id)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = s.db.ExecContext(ctx, s.q("UPDATE pieces SET slot_id = $1 WHERE namespace = $2 AND key = $3 AND instance = $4"),
+		id,
+		ref.Namespace,
+		ref.Key,
+		s.instance)
+	return errors.WithStack(err)
+}
+
+func (s *sqlIndex) UnusedFiles(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.q("select file from (select slots.file,max(pieces.slot_id) as max from slots LEFT JOIN pieces on pieces.slot_id = slots.id and pieces.trash = false where slots.instance = $1 group by slots.file) a where max is null"), s.instance)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	var files []string
+	for rows.Next() {
+		var file string
+		err = rows.Scan(&file)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		files = append(files, file)
+	}
+	return files, errors.WithStack(rows.Err())
+}
+
+func (s *sqlIndex) DeleteSlots(ctx context.Context, file string) error {
+	_, err := s.db.ExecContext(ctx, s.q("DELETE FROM slots where file = $1 AND instance = $2"), file, s.instance)
+	return errors.WithStack(err)
+}
+
+func (s *sqlIndex) FileUsage(ctx context.Context) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, s.q("SELECT slots.file, sum(CASE WHEN pieces.slot_id IS NULL THEN 0 ELSE slots.size END) FROM slots LEFT JOIN pieces ON pieces.slot_id = slots.id WHERE slots.instance = $1 GROUP BY slots.file"), s.instance)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	usage := map[string]int64{}
+	for rows.Next() {
+		var file string
+		var used int64
+		err = rows.Scan(&file, &used)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		usage[file] = used
+	}
+	return usage, errors.WithStack(rows.Err())
+}
+
+func (s *sqlIndex) FileInUse(ctx context.Context, file string) (bool, error) {
+	var used int
+	err := s.db.QueryRowContext(ctx, s.q("SELECT 1 FROM slots JOIN pieces ON pieces.instance = slots.instance AND pieces.slot_id = slots.id WHERE file = $1 AND slots.instance = $2 LIMIT 1"), file, s.instance).Scan(&used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, errors.WithStack(err)
+}
+
+func (s *sqlIndex) WalkFile(ctx context.Context, file string, fn func(Piece) error) error {
+	rows, err := s.db.QueryContext(ctx, s.q("SELECT namespace,key,pieces.size,trash,created,accessed,slots.id,file,slots.size,start,checksum FROM pieces JOIN slots on slots.id = pieces.slot_id WHERE file = $1 AND slots.instance = $2 ORDER BY start"), file, s.instance)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Piece
+		err = rows.Scan(&p.Ref.Namespace, &p.Ref.Key, &p.Size, &p.Trash, &p.Created, &p.Accessed, &p.Slot.ID, &p.Slot.File, &p.Slot.Size, &p.Slot.Start, &p.Slot.Checksum)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err := fn(p)
+		if err != nil {
+			return err
+		}
+	}
+	return errors.WithStack(rows.Err())
+}
+
+func (s *sqlIndex) ListSlots(ctx context.Context, after Slot, limit int) ([]Piece, error) {
+	rows, err := s.db.QueryContext(ctx, s.q("SELECT namespace,key,pieces.size,trash,created,accessed,slots.id,file,slots.size,start,checksum FROM pieces JOIN slots on slots.id = pieces.slot_id WHERE NOT trash AND slots.instance = $5 AND (file > $1 OR (file = $1 AND (start > $2 OR (start = $2 AND slots.id > $3)))) ORDER BY file, start, slots.id LIMIT $4"), after.File, after.Start, after.ID, limit, s.instance)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	var pieces []Piece
+	for rows.Next() {
+		var p Piece
+		err = rows.Scan(&p.Ref.Namespace, &p.Ref.Key, &p.Size, &p.Trash, &p.Created, &p.Accessed, &p.Slot.ID, &p.Slot.File, &p.Slot.Size, &p.Slot.Start, &p.Slot.Checksum)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		pieces = append(pieces, p)
+	}
+	return pieces, errors.WithStack(rows.Err())
+}
+
+func (s *sqlIndex) WalkSlots(ctx context.Context, fn func(slot Slot, piece *Piece) error) error {
+	rows, err := s.db.QueryContext(ctx, s.q("SELECT slots.id,file,slots.size,start,checksum,namespace,key,pieces.size,trash FROM slots LEFT JOIN pieces on slots.id = pieces.slot_id WHERE slots.instance = $1 ORDER BY file, start, slots.id"), s.instance)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var slot Slot
+		var namespace, key []byte
+		var size *int64
+		var trash *bool
+		err = rows.Scan(&slot.ID, &slot.File, &slot.Size, &slot.Start, &slot.Checksum, &namespace, &key, &size, &trash)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		var piece *Piece
+		if size != nil {
+			piece = &Piece{
+				Ref:   blobstore.BlobRef{Namespace: namespace, Key: key},
+				Size:  *size,
+				Trash: *trash,
+				Slot:  slot,
+			}
+		}
+		err := fn(slot, piece)
+		if err != nil {
+			return err
+		}
+	}
+	return errors.WithStack(rows.Err())
+}
+
+func (s *sqlIndex) DeleteUnusedSlots(ctx context.Context, ids []int64) (deleted int, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			err = errs.Combine(err, tx.Rollback())
+		} else {
+			err = errors.WithStack(tx.Commit())
+		}
+	}()
+	for _, id := range ids {
+		res, err := tx.ExecContext(ctx, s.q("DELETE FROM slots WHERE id = $1 AND instance = $2 AND NOT EXISTS (SELECT 1 FROM pieces WHERE instance = $2 AND slot_id = $1)"), id, s.instance)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		deleted += int(affected)
+	}
+	return deleted, nil
+}
+
+func (s *sqlIndex) Relocate(ctx context.Context, moves []Relocation) (applied int, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			err = errs.Combine(err, tx.Rollback())
+		} else {
+			err = errors.WithStack(tx.Commit())
+		}
+	}()
+	for _, move := range moves {
+		var id int64
+		err = tx.QueryRowContext(ctx, s.q("INSERT INTO slots (file,size,start,checksum,instance) VALUES ($1,$2,$3,$4,$5) RETURNING id"),
+			move.To.File,
+			move.To.Size,
+			move.To.Start,
+			move.To.Checksum,
+			s.instance).Scan(&id)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		res, err := tx.ExecContext(ctx, s.q("UPDATE pieces SET slot_id = $1 WHERE namespace = $2 AND key = $3 AND slot_id = $4 AND instance = $5"),
+			id, move.Ref.Namespace, move.Ref.Key, move.From, s.instance)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		updated, err := res.RowsAffected()
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		obsolete := move.From
+		if updated == 0 {
+			// the piece is deleted or moved in the meantime
+			obsolete = id
+		} else {
+			applied++
+		}
+		_, err = tx.ExecContext(ctx, s.q("DELETE FROM slots WHERE id = $1 AND instance = $2"), obsolete, s.instance)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+	return applied, nil
+}
+
+// Close waits for the running group commit, and closes the database. The later inserts fail.
+func (s *sqlIndex) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	committed := s.committed
+	s.mu.Unlock()
+	if committed != nil {
+		<-committed
+	}
+	return errors.WithStack(s.db.Close())
+}
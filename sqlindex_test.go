@@ -0,0 +1,140 @@
+package largefile
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"storj.io/storj/storagenode/blobstore"
+	"sync"
+	"testing"
+)
+
+func TestGroupCommit(t *testing.T) {
+	ctx := context.Background()
+	index, err := openSqliteIndex(filepath.Join(t.TempDir(), sqliteFileName), "")
+	require.NoError(t, err)
+	defer index.Close()
+	require.NoError(t, index.Migrate(ctx))
+
+	ref := func(i int) blobstore.BlobRef {
+		return blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte(fmt.Sprintf("piece%d", i))}
+	}
+	require.NoError(t, index.Insert(ctx, ref(0), Slot{File: "a", Start: 0, Size: 10}))
+
+	// the duplicate fails without failing the others of the same transaction
+	errs := make([]error, 50)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = index.Insert(ctx, ref(i), Slot{File: "a", Start: int64(i+1) * 10, Size: 10})
+		}(i)
+	}
+	wg.Wait()
+	require.Error(t, errs[0])
+	for i := 1; i < len(errs); i++ {
+		require.NoError(t, errs[i])
+		piece, err := index.Get(ctx, ref(i))
+		require.NoError(t, err)
+		require.Equal(t, int64(i+1)*10, piece.Slot.Start)
+	}
+
+	slots := 0
+	require.NoError(t, index.WalkSlots(ctx, func(slot Slot, piece *Piece) error {
+		require.NotNil(t, piece, "slot without piece")
+		slots++
+		return nil
+	}))
+	require.Equal(t, 50, slots)
+}
+
+func TestGroupCommitCancelAndClose(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), sqliteFileName)
+	index, err := openSqliteIndex(path, "")
+	require.NoError(t, err)
+	require.NoError(t, index.Migrate(ctx))
+
+	ref := func(i int) blobstore.BlobRef {
+		return blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte(fmt.Sprintf("piece%d", i))}
+	}
+
+	// a canceled insert is either committed or not inserted at all
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = index.Insert(canceled, ref(0), Slot{File: "a", Size: 10})
+	_, getErr := index.Get(ctx, ref(0))
+	if err == nil {
+		require.NoError(t, getErr)
+	} else {
+		require.ErrorIs(t, err, context.Canceled)
+		require.ErrorIs(t, getErr, os.ErrNotExist)
+	}
+
+	// closed during the inserts: the accepted ones are committed, the others are refused
+	results := make([]error, 50)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = index.Insert(ctx, ref(i+1), Slot{File: "a", Start: int64(i+1) * 10, Size: 10})
+		}(i)
+	}
+	require.NoError(t, index.Close())
+	wg.Wait()
+
+	index, err = openSqliteIndex(path, "")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, index.Close()) }()
+	for i, err := range results {
+		_, getErr := index.Get(ctx, ref(i+1))
+		if err == nil {
+			require.NoError(t, getErr)
+		} else {
+			require.ErrorContains(t, err, "index is closed")
+			require.ErrorIs(t, getErr, os.ErrNotExist)
+		}
+	}
+}
+
+func TestInstances(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), sqliteFileName)
+	var indexes []*sqlIndex
+	for _, instance := range []string{"node1", "node2"} {
+		index, err := openSqliteIndex(path, instance)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, index.Close()) }()
+		require.NoError(t, index.Migrate(ctx))
+		indexes = append(indexes, index)
+	}
+	node1, node2 := indexes[0], indexes[1]
+
+	ref := blobstore.BlobRef{Namespace: []byte("ns"), Key: []byte("piece")}
+	require.NoError(t, node1.Insert(ctx, ref, Slot{File: "a", Size: 10}))
+	_, err := node2.Get(ctx, ref)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, node2.Insert(ctx, ref, Slot{File: "b", Size: 20}))
+
+	require.NoError(t, node1.SetMetas(ctx, map[string]string{metaNodeID: "1"}))
+	_, err = node2.GetMeta(ctx, metaNodeID)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	usage, err := node2.FileUsage(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"b": 20}, usage)
+
+	deleted, err := node2.DeleteNamespace(ctx, ref.Namespace, 100)
+	require.NoError(t, err)
+	require.Len(t, deleted, 1)
+	piece, err := node1.Get(ctx, ref)
+	require.NoError(t, err)
+	require.Equal(t, "a", piece.Slot.File)
+	used, err := node1.SpaceUsedForBlobs(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), used)
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
 	"os"
-	"path/filepath"
 	"storj.io/common/context2"
 	"storj.io/common/testcontext"
 	"storj.io/private/dbutil/pgutil"
@@ -25,11 +24,35 @@ func TestStores(t *testing.T, e func(ctx context.Context, t *testing.T, store bl
 		require.NoError(t, err)
 		e(ctx, t, store)
 	})
+	TestLargeStores(t, func(ctx context.Context, t *testing.T, store *LargeFileStore) {
+		e(ctx, t, store)
+	})
+}
+
+// TestLargeStores runs the test with LargeFileStore using all the metadata backends.
+func TestLargeStores(t *testing.T, e func(ctx context.Context, t *testing.T, store *LargeFileStore)) {
+	ctx := testcontext.New(t)
+	defer ctx.Cleanup()
 	t.Run("largestore", func(t *testing.T) {
 		TestWithDb(t, ctx, func(ctx context.Context, store *LargeFileStore) {
 			e(ctx, t, store)
 		})
 	})
+	t.Run("sqlitestore", func(t *testing.T) {
+		TestWithSqlite(t, ctx, func(ctx context.Context, store *LargeFileStore) {
+			e(ctx, t, store)
+		})
+	})
+	t.Run("logstore", func(t *testing.T) {
+		TestWithLog(t, ctx, func(ctx context.Context, store *LargeFileStore) {
+			e(ctx, t, store)
+		})
+	})
+	t.Run("memstore", func(t *testing.T) {
+		TestWithMemory(t, ctx, func(ctx context.Context, store *LargeFileStore) {
+			e(ctx, t, store)
+		})
+	})
 }
 
 func TestWithDb(t *testing.T, ctx context.Context, test func(ctx context.Context, store *LargeFileStore)) {
@@ -37,25 +60,63 @@ func TestWithDb(t *testing.T, ctx context.Context, test func(ctx context.Context
 	schemaName := "largefile-" + pgutil.CreateRandomTestingSchemaName(8)
 	c := os.Getenv("STORE_TEST_CONN")
 	if c == "" {
-		c = "postgres://postgres@localhost:5432/storage"
+		t.Skip("STORE_TEST_CONN is not set (e.g. postgres://postgres@localhost:5432/storage)")
 	}
 	fmt.Println(schemaName)
 	connStrWithSchema := pgutil.ConnstrWithSchema(c, schemaName)
 
-	storeDir := t.TempDir()
-	require.NoError(t, os.WriteFile(filepath.Join(storeDir, "storage-largefile-verification"), []byte("test"), 0644))
-	store, err := NewBlobStore(connStrWithSchema, storeDir)
+	db, err := sql.Open("pgx", connStrWithSchema)
 	require.NoError(t, err)
+	defer db.Close()
 
-	require.NoError(t, pgutil.CreateSchema(ctx, store.conn, schemaName))
+	require.NoError(t, pgutil.CreateSchema(ctx, db, schemaName))
 	defer func(db *sql.DB) error {
 		childCtx, cancel := context.WithTimeout(context2.WithoutCancellation(ctx), 15*time.Second)
 		defer cancel()
 		return pgutil.DropSchema(childCtx, db, schemaName)
-	}(store.conn)
+	}(db)
 
+	storeDir := t.TempDir()
+	store, err := NewBlobStore(zaptest.NewLogger(t), testConfig(connStrWithSchema, storeDir))
+	require.NoError(t, err)
 	defer store.Close()
-	err = InitTable(store.conn)
+
+	test(ctx, store)
+}
+
+func TestWithSqlite(t *testing.T, ctx context.Context, test func(ctx context.Context, store *LargeFileStore)) {
+	storeDir := t.TempDir()
+	store, err := NewBlobStore(zaptest.NewLogger(t), testConfig("sqlite:", storeDir))
+	require.NoError(t, err)
+	defer store.Close()
+
+	test(ctx, store)
+}
+
+func TestWithLog(t *testing.T, ctx context.Context, test func(ctx context.Context, store *LargeFileStore)) {
+	storeDir := t.TempDir()
+	store, err := NewBlobStore(zaptest.NewLogger(t), testConfig("log:", storeDir))
+	require.NoError(t, err)
+	defer store.Close()
+
+	test(ctx, store)
+}
+
+func TestWithMemory(t *testing.T, ctx context.Context, test func(ctx context.Context, store *LargeFileStore)) {
+	storeDir := t.TempDir()
+	store, err := NewBlobStore(zaptest.NewLogger(t), testConfig("memory:", storeDir))
 	require.NoError(t, err)
+	defer store.Close()
+
 	test(ctx, store)
 }
+
+// testConfig returns the default configuration with the given metadata backend and directory. The
+// background compaction is disabled, the tests compact explicitly.
+func testConfig(connDef string, dir string) Config {
+	config := DefaultConfig
+	config.Connection = connDef
+	config.Dir = dir
+	config.Compaction.Disabled = true
+	return config
+}
@@ -2,95 +2,119 @@ package largefile
 
 import (
 	"context"
-	"database/sql"
-	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/pkg/errors"
+	"hash"
+	"hash/crc32"
 	"io"
-	"os"
-	"path/filepath"
 	"storj.io/storj/storagenode/blobstore"
 	"storj.io/storj/storagenode/blobstore/filestore"
 )
 
+// writer writes a piece into a region of a shared segment file.
 type writer struct {
-	ref       blobstore.BlobRef
-	conn      *sql.DB
-	output    *os.File
-	filePath  string
-	committed bool
+	ref      blobstore.BlobRef
+	index    Index
+	segments *segments
+	region   *region
+	pos      int64
+	written  int64
+	closed   bool
+
+	// hash is calculated while the data is written sequentially, otherwise the checksum is
+	// calculated from the file at commit.
+	hash   hash.Hash32
+	hashed int64
+	rehash bool
 }
 
-func NewWriter(db *sql.DB, dir string, ref blobstore.BlobRef) (*writer, error) {
-	fileName := filepath.Join(dir, RefToFile(ref))
-	_ = os.MkdirAll(filepath.Dir(fileName), 0755)
-	output, err := os.Create(fileName)
+func NewWriter(index Index, segments *segments, ref blobstore.BlobRef, size int64) (*writer, error) {
+	r, err := segments.reserve(size)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
 	return &writer{
-		conn:     db,
+		index:    index,
 		ref:      ref,
-		output:   output,
-		filePath: fileName,
+		segments: segments,
+		region:   r,
+		hash:     crc32.New(castagnoli),
 	}, nil
 }
+
 func (w *writer) Seek(offset int64, whence int) (int64, error) {
-	return w.output.Seek(offset, whence)
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += w.pos
+	case io.SeekEnd:
+		offset += w.written
+	default:
+		return 0, errors.New("Unsupported whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position")
+	}
+	w.pos = offset
+	return w.pos, nil
 }
 
 func (w *writer) Cancel(ctx context.Context) error {
-	if w.committed {
+	if w.closed {
 		return nil
 	}
-	_ = w.output.Close()
-	return os.Remove(w.filePath)
+	w.closed = true
+	w.segments.release(w.region, w.written)
+	return nil
 }
 
 func (w *writer) Commit(ctx context.Context) error {
-	if w.committed {
+	if w.closed {
 		return errors.New("Too much commit")
 	}
-	w.committed = true
+	w.closed = true
+	defer func() {
+		w.segments.release(w.region, w.written)
+	}()
 
-	position, err := w.output.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return err
-	}
-	err = w.output.Truncate(position)
-	if err != nil {
-		return err
+	if w.pos > w.written {
+		// seeking beyond the written data: make sure the zeroes are part of the file
+		if w.pos > w.region.cap {
+			if err := w.segments.grow(w.region, w.pos, w.written); err != nil {
+				return err
+			}
+		}
+		if _, err := w.region.seg.file.WriteAt([]byte{0}, w.region.start+w.pos-1); err != nil {
+			return errors.WithStack(err)
+		}
+		w.segments.written(w.pos - w.written)
+		w.written = w.pos
 	}
 
-	stat, err := w.output.Stat()
+	checksum, err := w.checksum()
 	if err != nil {
 		return err
 	}
-
-	err = w.output.Close()
+	err = w.segments.sync(w.region)
 	if err != nil {
 		return err
 	}
+	return w.index.Insert(ctx, w.ref, Slot{
+		File:     w.region.seg.name,
+		Start:    w.region.start,
+		Size:     w.pos,
+		Checksum: &checksum,
+	})
+}
 
-	var id int64
-	err = w.conn.QueryRow("INSERT INTO slots (file,size,start) VALUES ($1,$2,0) RETURNING id",
-		RefToFile(w.ref),
-		stat.Size()).Scan(&id)
-	if err != nil {
-		return err
+func (w *writer) checksum() (uint32, error) {
+	if !w.rehash && w.hashed == w.pos {
+		return w.hash.Sum32(), nil
 	}
-
-	_, err = w.conn.Exec("INSERT INTO pieces (namespace,key,size,slot_id) VALUES ($1,$2,$3,$4)",
-		w.ref.Namespace,
-		w.ref.Key,
-		stat.Size(),
-		id)
-	return errors.WithStack(err)
-
+	return checksumRange(w.region.seg.file, w.region.start, w.pos)
 }
 
 func (w *writer) Size() (int64, error) {
-	stat, err := w.output.Stat()
-	return stat.Size(), err
+	return w.pos, nil
 }
 
 func (w *writer) StorageFormatVersion() blobstore.FormatVersion {
@@ -98,5 +122,28 @@ func (w *writer) StorageFormatVersion() blobstore.FormatVersion {
 }
 
 func (w *writer) Write(p []byte) (n int, err error) {
-	return w.output.Write(p)
+	if w.closed {
+		return 0, errors.New("Writer is already closed")
+	}
+	end := w.pos + int64(len(p))
+	if end > w.region.cap {
+		err = w.segments.grow(w.region, end, w.written)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err = w.region.seg.file.WriteAt(p, w.region.start+w.pos)
+	if w.pos != w.hashed {
+		w.rehash = true
+	}
+	if !w.rehash {
+		_, _ = w.hash.Write(p[:n])
+		w.hashed += int64(n)
+	}
+	w.pos += int64(n)
+	if w.pos > w.written {
+		w.segments.written(w.pos - w.written)
+		w.written = w.pos
+	}
+	return n, errors.WithStack(err)
 }